@@ -0,0 +1,348 @@
+package apns
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+var (
+	// oidUID is the userId attribute type, used by Apple to store the bundle
+	// ID in the subject of APNs certificates
+	oidUID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+	// Extensions of APNs certificates
+	oidAPNsSandbox    = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 1}
+	oidAPNsProduction = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 2}
+	oidAPNsTopics     = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 6}
+)
+
+// CertificateEnvironment tells which APNs environments a certificate is valid
+// for
+type CertificateEnvironment uint8
+
+// Values of CertificateEnvironment. A certificate may be valid for both.
+const (
+	SandboxEnvironment CertificateEnvironment = 1 << iota
+	ProductionEnvironment
+)
+
+func (e CertificateEnvironment) String() string {
+	switch e {
+	case SandboxEnvironment:
+		return "sandbox"
+	case ProductionEnvironment:
+		return "production"
+	case SandboxEnvironment | ProductionEnvironment:
+		return "sandbox+production"
+	}
+	return "unknown"
+}
+
+// CertificateInfo describes the leaf of a client certificate
+type CertificateInfo struct {
+	CommonName   string
+	UID          string
+	Organization string
+	Issuer       string
+	SerialNumber string
+	NotBefore    time.Time
+	NotAfter     time.Time
+	// Topics are the bundle IDs the certificate can send notifications to
+	Topics []string
+	// Environment is zero if the certificate is not an APNs certificate
+	Environment CertificateEnvironment
+}
+
+// CertificateError reports that the client certificate has expired, or that
+// APNs rejected it during the TLS handshake
+type CertificateError struct {
+	Expired  bool
+	Revoked  bool
+	NotAfter time.Time
+	Err      error
+}
+
+func (e *CertificateError) Error() string {
+	return fmt.Sprintf("client certificate rejected: %v", e.Err)
+}
+
+func (e *CertificateError) Unwrap() error {
+	return e.Err
+}
+
+// InspectCertificate returns information about the leaf of cert
+func InspectCertificate(cert *tls.Certificate) (*CertificateInfo, error) {
+	leaf, err := certificateLeaf(cert)
+	if err != nil {
+		return nil, err
+	}
+	return newCertificateInfo(leaf), nil
+}
+
+// CheckGateway returns an error if the certificate is not valid for the APNs
+// environment of the gateway at addr. Addresses that are not Apple gateways
+// are not checked.
+func (ci *CertificateInfo) CheckGateway(addr string) error {
+	env := gatewayEnvironment(addr)
+	if env == 0 || ci.Environment&env != 0 {
+		return nil
+	}
+	return fmt.Errorf("certificate %q is valid for the %v environment, but %v is a %v gateway", ci.CommonName, ci.Environment, addr, env)
+}
+
+func gatewayEnvironment(addr string) CertificateEnvironment {
+	switch addr {
+	case SenderGateway, FeedbackGateway:
+		return ProductionEnvironment
+	case SenderSandboxGateway, FeedbackSandboxGateway:
+		return SandboxEnvironment
+	}
+	return 0
+}
+
+func certificateLeaf(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("empty certificate")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing certificate: %v", err)
+	}
+	return leaf, nil
+}
+
+func newCertificateInfo(leaf *x509.Certificate) *CertificateInfo {
+	ci := &CertificateInfo{
+		CommonName:   leaf.Subject.CommonName,
+		Issuer:       leaf.Issuer.CommonName,
+		SerialNumber: leaf.SerialNumber.String(),
+		NotBefore:    leaf.NotBefore,
+		NotAfter:     leaf.NotAfter,
+	}
+
+	if len(leaf.Subject.Organization) > 0 {
+		ci.Organization = leaf.Subject.Organization[0]
+	}
+
+	for _, name := range leaf.Subject.Names {
+		if name.Type.Equal(oidUID) {
+			if uid, ok := name.Value.(string); ok {
+				ci.UID = uid
+			}
+		}
+	}
+
+	for _, ext := range leaf.Extensions {
+		switch {
+		case ext.Id.Equal(oidAPNsSandbox):
+			ci.Environment |= SandboxEnvironment
+		case ext.Id.Equal(oidAPNsProduction):
+			ci.Environment |= ProductionEnvironment
+		case ext.Id.Equal(oidAPNsTopics):
+			ci.Topics = parseTopicsExtension(ext.Value)
+		}
+	}
+
+	if ci.Topics == nil && ci.Environment != 0 && ci.UID != "" {
+		ci.Topics = []string{ci.UID}
+	}
+
+	return ci
+}
+
+// parseTopicsExtension parses the topics extension of universal APNs
+// certificates: a sequence of topics, each followed by a sequence describing
+// its type.
+func parseTopicsExtension(der []byte) []string {
+	var seq asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &seq); err != nil || seq.Tag != asn1.TagSequence {
+		return nil
+	}
+
+	var topics []string
+	for rest := seq.Bytes; len(rest) > 0; {
+		var elem asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &elem); err != nil {
+			break
+		}
+		if elem.Class == asn1.ClassUniversal && elem.Tag == asn1.TagUTF8String {
+			topics = append(topics, string(elem.Bytes))
+		}
+	}
+
+	return topics
+}
+
+// LoadPKCS12 loads a certificate and its private key from PKCS#12 (.p12) data,
+// as exported by Keychain Access
+func LoadPKCS12(data []byte, password string) (*tls.Certificate, *CertificateInfo, error) {
+	key, leaf, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed decoding PKCS#12 data: %v", err)
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+
+	if err := checkKeyPair(leaf, key); err != nil {
+		return nil, nil, err
+	}
+
+	return cert, newCertificateInfo(leaf), nil
+}
+
+// LoadPKCS12File is like LoadPKCS12 but reads the data from a file
+func LoadPKCS12File(path, password string) (*tls.Certificate, *CertificateInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return LoadPKCS12(data, password)
+}
+
+// LoadPEM loads a certificate and its private key from PEM data. The key may
+// be encrypted, either as a legacy encrypted PEM block or as an encrypted
+// PKCS#8 key, in which case password is used to decrypt it.
+func LoadPEM(certPEM, keyPEM []byte, password string) (*tls.Certificate, *CertificateInfo, error) {
+	data := make([]byte, 0, len(certPEM)+len(keyPEM)+1)
+	data = append(data, certPEM...)
+	data = append(data, '\n')
+	data = append(data, keyPEM...)
+	return LoadPEMBundle(data, password)
+}
+
+// LoadPEMFiles is like LoadPEM but reads the data from files
+func LoadPEMFiles(certFile, keyFile, password string) (*tls.Certificate, *CertificateInfo, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return LoadPEM(certPEM, keyPEM, password)
+}
+
+// LoadPEMBundle loads a certificate chain and its private key from PEM data
+// containing both. The leaf certificate must come first.
+func LoadPEMBundle(data []byte, password string) (*tls.Certificate, *CertificateInfo, error) {
+	var cert tls.Certificate
+	var block *pem.Block
+
+	for {
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY", "ENCRYPTED PRIVATE KEY":
+			if cert.PrivateKey != nil {
+				return nil, nil, errors.New("found more than one private key")
+			}
+			key, err := parsePEMPrivateKey(block, password)
+			if err != nil {
+				return nil, nil, err
+			}
+			cert.PrivateKey = key
+		}
+	}
+
+	if len(cert.Certificate) == 0 {
+		return nil, nil, errors.New("no certificate found in PEM data")
+	}
+	if cert.PrivateKey == nil {
+		return nil, nil, errors.New("no private key found in PEM data")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed parsing certificate: %v", err)
+	}
+	cert.Leaf = leaf
+
+	if err := checkKeyPair(leaf, cert.PrivateKey); err != nil {
+		return nil, nil, err
+	}
+
+	return &cert, newCertificateInfo(leaf), nil
+}
+
+// LoadPEMBundleFile is like LoadPEMBundle but reads the data from a file
+func LoadPEMBundleFile(path, password string) (*tls.Certificate, *CertificateInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return LoadPEMBundle(data, password)
+}
+
+func parsePEMPrivateKey(block *pem.Block, password string) (crypto.PrivateKey, error) {
+	der := block.Bytes
+
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		key, err := pkcs8.ParsePKCS8PrivateKey(der, []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("failed decrypting private key: %v", err)
+		}
+		return key, nil
+	}
+
+	// legacy "Proc-Type: 4,ENCRYPTED" blocks
+	if x509.IsEncryptedPEMBlock(block) {
+		var err error
+		der, err = x509.DecryptPEMBlock(block, []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("failed decrypting private key: %v", err)
+		}
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	return nil, errors.New("failed parsing private key")
+}
+
+func checkKeyPair(leaf *x509.Certificate, key crypto.PrivateKey) error {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return errors.New("unsupported private key type")
+	}
+	pub, ok := signer.Public().(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	if !ok || !pub.Equal(leaf.PublicKey) {
+		return errors.New("private key does not match certificate")
+	}
+	return nil
+}
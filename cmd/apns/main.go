@@ -0,0 +1,102 @@
+// Command apns is a command line tool for APNs client certificates
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mentionapp/apns.go"
+)
+
+const usage = `Usage: apns <command> [arguments]
+
+Commands:
+  inspect    print the topics, environment and expiry of a certificate
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "inspect":
+		os.Exit(inspect(os.Args[2:]))
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func inspect(args []string) int {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	password := fs.String("password", "", "password of the .p12 file or of the encrypted private key")
+	keyFile := fs.String("key", "", "private key file, if not bundled with the certificate")
+	gateway := fs.String("gateway", "", "fail if the certificate is not valid for this gateway (e.g. "+apns.SenderGateway+")")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: apns inspect [flags] <cert.p12|cert.pem>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	cert, err := loadCertificate(fs.Arg(0), *keyFile, *password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apns: %v\n", err)
+		return 1
+	}
+
+	info, err := apns.InspectCertificate(cert)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apns: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Subject:     %v\n", info.CommonName)
+	fmt.Printf("Issuer:      %v\n", info.Issuer)
+	fmt.Printf("Topics:      %v\n", strings.Join(info.Topics, ", "))
+	fmt.Printf("Environment: %v\n", info.Environment)
+	fmt.Printf("Expires:     %v (%v days)\n", info.NotAfter.Format(time.RFC3339), int(time.Until(info.NotAfter).Hours()/24))
+
+	status := 0
+
+	if time.Now().After(info.NotAfter) {
+		fmt.Fprintln(os.Stderr, "apns: certificate has expired")
+		status = 1
+	}
+
+	if *gateway != "" {
+		if err := info.CheckGateway(*gateway); err != nil {
+			fmt.Fprintf(os.Stderr, "apns: %v\n", err)
+			status = 1
+		}
+	}
+
+	return status
+}
+
+func loadCertificate(path, keyFile, password string) (*tls.Certificate, error) {
+	var cert *tls.Certificate
+	var err error
+
+	switch {
+	case strings.EqualFold(filepath.Ext(path), ".p12"), strings.EqualFold(filepath.Ext(path), ".pfx"):
+		cert, _, err = apns.LoadPKCS12File(path, password)
+	case keyFile != "":
+		cert, _, err = apns.LoadPEMFiles(path, keyFile, password)
+	default:
+		cert, _, err = apns.LoadPEMBundleFile(path, password)
+	}
+
+	return cert, err
+}
@@ -0,0 +1,263 @@
+/*
+Package codec encodes and decodes the frames of the APNs binary protocol:
+notifications (commands 0, 1 and 2), error-responses and feedback tuples
+*/
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Commands of the binary protocol
+const (
+	SimpleNotificationCommand   uint8 = 0
+	EnhancedNotificationCommand uint8 = 1
+	NotificationCommand         uint8 = 2
+	ErrorResponseCommand        uint8 = 8
+)
+
+// Item identifiers of command 2 frames
+const (
+	DeviceTokenItem uint8 = 1
+	PayloadItem     uint8 = 2
+	IdentifierItem  uint8 = 3
+	ExpiryItem      uint8 = 4
+	PriorityItem    uint8 = 5
+)
+
+const (
+	identifierItemLen  = 4
+	expiryItemLen      = 4
+	priorityItemLen    = 1
+	notificationHeader = 5
+)
+
+// MaxFrameLen is the maximum length of a command 2 frame, after its header,
+// with each item present once
+const MaxFrameLen = 2*(3+math.MaxUint16) + 3 + identifierItemLen + 3 + expiryItemLen + 3 + priorityItemLen
+
+// ErrorResponseLen is the length of an error-response packet
+const ErrorResponseLen = 6
+
+// FeedbackHeaderLen is the length of a feedback tuple without its token
+const FeedbackHeaderLen = 6
+
+var (
+	// ErrUnknownCommand is returned when decoding a frame with an unexpected
+	// command
+	ErrUnknownCommand = errors.New("codec: unknown command")
+	// ErrMalformed is returned when decoding an inconsistent frame
+	ErrMalformed = errors.New("codec: malformed frame")
+	// ErrTooLong is returned when encoding a token or payload whose length
+	// does not fit in the frame
+	ErrTooLong = errors.New("codec: item too long")
+)
+
+// Notification is a notification in any of the three formats. Command
+// selects the format; Identifier and Expiry are not part of command 0, and
+// Priority is only part of command 2, where it is always encoded, even if 0.
+type Notification struct {
+	Command    uint8
+	Token      []byte
+	Payload    []byte
+	Identifier uint32
+	Expiry     uint32
+	Priority   uint8
+}
+
+// Encode encodes n
+func (n *Notification) Encode() ([]byte, error) {
+	if len(n.Token) > math.MaxUint16 || len(n.Payload) > math.MaxUint16 {
+		return nil, ErrTooLong
+	}
+
+	BE := binary.BigEndian
+
+	switch n.Command {
+	case SimpleNotificationCommand:
+		b := []byte{n.Command}
+		b = appendItem(b, n.Token)
+		return appendItem(b, n.Payload), nil
+
+	case EnhancedNotificationCommand:
+		b := []byte{n.Command}
+		b = BE.AppendUint32(b, n.Identifier)
+		b = BE.AppendUint32(b, n.Expiry)
+		b = appendItem(b, n.Token)
+		return appendItem(b, n.Payload), nil
+
+	case NotificationCommand:
+		return n.encodeFrame(), nil
+	}
+
+	return nil, fmt.Errorf("%w %v", ErrUnknownCommand, n.Command)
+}
+
+func (n *Notification) encodeFrame() []byte {
+	BE := binary.BigEndian
+
+	b := make([]byte, notificationHeader)
+	b[0] = NotificationCommand
+
+	b = append(b, DeviceTokenItem)
+	b = appendItem(b, n.Token)
+	b = append(b, PayloadItem)
+	b = appendItem(b, n.Payload)
+	b = append(b, IdentifierItem)
+	b = BE.AppendUint16(b, identifierItemLen)
+	b = BE.AppendUint32(b, n.Identifier)
+	b = append(b, ExpiryItem)
+	b = BE.AppendUint16(b, expiryItemLen)
+	b = BE.AppendUint32(b, n.Expiry)
+	b = append(b, PriorityItem)
+	b = BE.AppendUint16(b, priorityItemLen)
+	b = append(b, n.Priority)
+
+	BE.PutUint32(b[1:notificationHeader], uint32(len(b)-notificationHeader))
+
+	return b
+}
+
+// appendItem appends the length of item followed by item
+func appendItem(b []byte, item []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(item)))
+	return append(b, item...)
+}
+
+// DecodeNotification decodes a notification frame of any format. The token
+// and the payload of the result share the memory of b.
+func DecodeNotification(b []byte) (*Notification, error) {
+	if len(b) == 0 {
+		return nil, ErrMalformed
+	}
+
+	BE := binary.BigEndian
+	n := &Notification{Command: b[0]}
+	b = b[1:]
+
+	var err error
+
+	switch n.Command {
+	case SimpleNotificationCommand:
+	case EnhancedNotificationCommand:
+		if len(b) < 8 {
+			return nil, ErrMalformed
+		}
+		n.Identifier = BE.Uint32(b)
+		n.Expiry = BE.Uint32(b[4:])
+		b = b[8:]
+	case NotificationCommand:
+		if err := n.decodeFrame(b); err != nil {
+			return nil, err
+		}
+		return n, nil
+	default:
+		return nil, fmt.Errorf("%w %v", ErrUnknownCommand, n.Command)
+	}
+
+	if n.Token, b, err = readItem(b); err != nil {
+		return nil, err
+	}
+	if n.Payload, b, err = readItem(b); err != nil {
+		return nil, err
+	}
+	if len(b) != 0 {
+		return nil, ErrMalformed
+	}
+
+	return n, nil
+}
+
+func (n *Notification) decodeFrame(b []byte) error {
+	BE := binary.BigEndian
+
+	if len(b) < 4 || uint64(len(b)-4) != uint64(BE.Uint32(b)) || len(b)-4 > MaxFrameLen {
+		return ErrMalformed
+	}
+	b = b[4:]
+
+	for len(b) > 0 {
+		id := b[0]
+
+		data, rest, err := readItem(b[1:])
+		if err != nil {
+			return err
+		}
+		b = rest
+
+		switch {
+		case id == DeviceTokenItem:
+			n.Token = data
+		case id == PayloadItem:
+			n.Payload = data
+		case id == IdentifierItem && len(data) == identifierItemLen:
+			n.Identifier = BE.Uint32(data)
+		case id == ExpiryItem && len(data) == expiryItemLen:
+			n.Expiry = BE.Uint32(data)
+		case id == PriorityItem && len(data) == priorityItemLen:
+			n.Priority = data[0]
+		default:
+			return fmt.Errorf("%w: invalid item %v of length %v", ErrMalformed, id, len(data))
+		}
+	}
+
+	return nil
+}
+
+// readItem reads a length-prefixed item from b, and returns the rest of b
+func readItem(b []byte) (item, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, nil, ErrMalformed
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+l {
+		return nil, nil, ErrMalformed
+	}
+	return b[2 : 2+l], b[2+l:], nil
+}
+
+// ErrorResponse is an error-response packet
+type ErrorResponse struct {
+	Command    uint8
+	Status     uint8
+	Identifier uint32
+}
+
+// Encode encodes r
+func (r *ErrorResponse) Encode() []byte {
+	b := []byte{r.Command, r.Status}
+	return binary.BigEndian.AppendUint32(b, r.Identifier)
+}
+
+// DecodeErrorResponse decodes an error-response packet. It does not check
+// the command.
+func DecodeErrorResponse(b []byte) (*ErrorResponse, error) {
+	if len(b) != ErrorResponseLen {
+		return nil, fmt.Errorf("%w: expected %v bytes, got %v", ErrMalformed, ErrorResponseLen, len(b))
+	}
+
+	return &ErrorResponse{
+		Command:    b[0],
+		Status:     b[1],
+		Identifier: binary.BigEndian.Uint32(b[2:]),
+	}, nil
+}
+
+// FeedbackTuple is a tuple sent by the feedback service
+type FeedbackTuple struct {
+	Time  uint32
+	Token []byte
+}
+
+// Encode encodes t
+func (t *FeedbackTuple) Encode() ([]byte, error) {
+	if len(t.Token) > math.MaxUint16 {
+		return nil, ErrTooLong
+	}
+
+	b := binary.BigEndian.AppendUint32(nil, t.Time)
+	return appendItem(b, t.Token), nil
+}
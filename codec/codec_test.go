@@ -0,0 +1,179 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var token = bytes.Repeat([]byte{0xab}, 32)
+
+func TestNotificationRoundTrip(t *testing.T) {
+
+	for _, n := range []*Notification{
+		{Command: SimpleNotificationCommand, Token: token, Payload: []byte(`{}`)},
+		{Command: EnhancedNotificationCommand, Token: token, Payload: []byte(`{}`), Identifier: 7, Expiry: 1400000000},
+		{Command: NotificationCommand, Token: token, Payload: []byte(`{}`), Identifier: 7, Expiry: 1400000000, Priority: 10},
+		{Command: NotificationCommand, Token: token, Payload: []byte(`{}`), Identifier: 7},
+	} {
+		b, err := n.Encode()
+		require.NoError(t, err)
+
+		decoded, err := DecodeNotification(b)
+		require.NoError(t, err)
+		assert.Equal(t, n, decoded)
+	}
+}
+
+func TestEncodeNotification(t *testing.T) {
+
+	n := &Notification{
+		Command:    NotificationCommand,
+		Token:      []byte{1, 2},
+		Payload:    []byte(`{}`),
+		Identifier: 1,
+		Expiry:     2,
+		Priority:   10,
+	}
+
+	b, err := n.Encode()
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte{
+		2, 0, 0, 0, 28,
+		1, 0, 2, 1, 2,
+		2, 0, 2, '{', '}',
+		3, 0, 4, 0, 0, 0, 1,
+		4, 0, 4, 0, 0, 0, 2,
+		5, 0, 1, 10,
+	}, b)
+
+	// the priority item is written even if 0
+	n.Priority = 0
+	b, err = n.Encode()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{5, 0, 1, 0}, b[len(b)-4:])
+
+	n.Command = 3
+	_, err = n.Encode()
+	assert.True(t, errors.Is(err, ErrUnknownCommand))
+
+	n.Command = NotificationCommand
+	n.Payload = make([]byte, 1<<16)
+	_, err = n.Encode()
+	assert.Equal(t, ErrTooLong, err)
+}
+
+func TestDecodeMalformedNotifications(t *testing.T) {
+
+	for _, b := range [][]byte{
+		{},
+		{0, 0, 2, 1},
+		{1, 0, 0},
+		{2, 0, 0, 0, 9, 1, 0, 2, 1, 2},
+		{2, 0, 0, 0, 4, 3, 0, 1, 0},
+		{0, 0, 0, 0, 0, 0},
+	} {
+		_, err := DecodeNotification(b)
+		assert.True(t, errors.Is(err, ErrMalformed), "%v", b)
+	}
+
+	_, err := DecodeNotification([]byte{9})
+	assert.True(t, errors.Is(err, ErrUnknownCommand))
+}
+
+func TestErrorResponseRoundTrip(t *testing.T) {
+
+	r := &ErrorResponse{Command: ErrorResponseCommand, Status: 8, Identifier: 42}
+
+	b := r.Encode()
+	assert.Equal(t, []byte{8, 8, 0, 0, 0, 42}, b)
+
+	decoded, err := DecodeErrorResponse(b)
+	require.NoError(t, err)
+	assert.Equal(t, r, decoded)
+
+	_, err = DecodeErrorResponse(b[:5])
+	assert.True(t, errors.Is(err, ErrMalformed))
+}
+
+func TestReader(t *testing.T) {
+
+	notifs := []*Notification{
+		{Command: SimpleNotificationCommand, Token: token, Payload: []byte(`{"a":1}`)},
+		{Command: EnhancedNotificationCommand, Token: token, Payload: []byte(`{"b":2}`), Identifier: 1, Expiry: 2},
+		{Command: NotificationCommand, Token: token, Payload: []byte(`{"c":3}`), Identifier: 3, Expiry: 4, Priority: 5},
+	}
+
+	buf := &bytes.Buffer{}
+	for _, n := range notifs {
+		b, err := n.Encode()
+		require.NoError(t, err)
+		buf.Write(b)
+	}
+
+	r := NewReader(buf)
+	for _, n := range notifs {
+		decoded, err := r.ReadNotification()
+		require.NoError(t, err)
+		assert.Equal(t, n, decoded)
+	}
+
+	_, err := r.ReadNotification()
+	assert.Equal(t, io.EOF, err)
+
+	b, _ := notifs[2].Encode()
+	_, err = NewReader(bytes.NewReader(b[:len(b)-1])).ReadNotification()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	_, err = NewReader(bytes.NewReader([]byte{9})).ReadNotification()
+	assert.True(t, errors.Is(err, ErrUnknownCommand))
+}
+
+func TestReadFeedbackTuples(t *testing.T) {
+
+	tuples := []*FeedbackTuple{
+		{Time: 1400000000, Token: token},
+		{Time: 1400000001, Token: []byte{1, 2, 3}},
+	}
+
+	buf := &bytes.Buffer{}
+	for _, tuple := range tuples {
+		b, err := tuple.Encode()
+		require.NoError(t, err)
+		buf.Write(b)
+	}
+	buf.Write([]byte{0, 0, 0, 1, 0, 32, 1})
+
+	r := NewReader(buf)
+	for _, tuple := range tuples {
+		decoded, err := r.ReadFeedbackTuple()
+		require.NoError(t, err)
+		assert.Equal(t, tuple, decoded)
+	}
+
+	_, err := r.ReadFeedbackTuple()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestReadErrorResponses(t *testing.T) {
+
+	r := NewReader(bytes.NewReader([]byte{8, 1, 0, 0, 0, 1, 8, 7}))
+
+	resp, err := r.ReadErrorResponse()
+	require.NoError(t, err)
+	assert.Equal(t, &ErrorResponse{Command: 8, Status: 1, Identifier: 1}, resp)
+
+	_, err = r.ReadErrorResponse()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestReaderRejectsLongFrames(t *testing.T) {
+
+	_, err := NewReader(bytes.NewReader([]byte{2, 0xff, 0xff, 0xff, 0xff})).ReadNotification()
+	assert.True(t, errors.Is(err, ErrMalformed))
+}
@@ -0,0 +1,72 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzDecodeNotification(f *testing.F) {
+
+	for _, n := range []*Notification{
+		{Command: SimpleNotificationCommand, Token: token, Payload: []byte(`{}`)},
+		{Command: EnhancedNotificationCommand, Token: token, Payload: []byte(`{}`), Identifier: 1, Expiry: 2},
+		{Command: NotificationCommand, Token: token, Payload: []byte(`{}`), Identifier: 1, Expiry: 2, Priority: 10},
+	} {
+		b, _ := n.Encode()
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		n, err := DecodeNotification(b)
+		if err != nil {
+			return
+		}
+
+		encoded, err := n.Encode()
+		if err != nil {
+			t.Fatalf("failed encoding decoded notification: %v", err)
+		}
+
+		decoded, err := DecodeNotification(encoded)
+		if err != nil {
+			t.Fatalf("failed decoding encoded notification: %v", err)
+		}
+		if !bytes.Equal(n.Token, decoded.Token) || !bytes.Equal(n.Payload, decoded.Payload) ||
+			n.Identifier != decoded.Identifier || n.Expiry != decoded.Expiry || n.Priority != decoded.Priority {
+			t.Fatalf("round trip changed %+v to %+v", n, decoded)
+		}
+	})
+}
+
+func FuzzReader(f *testing.F) {
+
+	b, _ := (&Notification{Command: NotificationCommand, Token: token, Payload: []byte(`{}`), Identifier: 1}).Encode()
+	f.Add(b)
+	f.Add([]byte{2, 0xff, 0xff, 0xff, 0xff})
+	tuple, _ := (&FeedbackTuple{Time: 1, Token: token}).Encode()
+	f.Add(tuple)
+	f.Add([]byte{8, 8, 0, 0, 0, 1})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r := NewReader(bytes.NewReader(b))
+		for {
+			if _, err := r.ReadNotification(); err != nil {
+				break
+			}
+		}
+
+		r = NewReader(bytes.NewReader(b))
+		for {
+			if _, err := r.ReadFeedbackTuple(); err != nil {
+				break
+			}
+		}
+
+		r = NewReader(bytes.NewReader(b))
+		for {
+			if _, err := r.ReadErrorResponse(); err != nil {
+				break
+			}
+		}
+	})
+}
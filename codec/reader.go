@@ -0,0 +1,109 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Reader reads frames from a stream. Its methods return io.EOF when the
+// stream ends between two frames, and io.ErrUnexpectedEOF when it ends in the
+// middle of a frame.
+type Reader struct {
+	r io.Reader
+}
+
+// NewReader creates a new Reader reading from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadNotification reads a notification in any of the three formats
+func (r *Reader) ReadNotification() (*Notification, error) {
+	var command [1]byte
+	if _, err := io.ReadFull(r.r, command[:]); err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	var err error
+
+	switch command[0] {
+	case SimpleNotificationCommand:
+		b, err = r.readItems(command[:], 2)
+	case EnhancedNotificationCommand:
+		if b, err = r.read(command[:], 8); err == nil {
+			b, err = r.readItems(b, 2)
+		}
+	case NotificationCommand:
+		if b, err = r.read(command[:], 4); err == nil {
+			l := binary.BigEndian.Uint32(b[1:])
+			if l > MaxFrameLen {
+				return nil, fmt.Errorf("%w: frame length %v is larger than %v", ErrMalformed, l, MaxFrameLen)
+			}
+			b, err = r.read(b, int(l))
+		}
+	default:
+		return nil, fmt.Errorf("%w %v", ErrUnknownCommand, command[0])
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeNotification(b)
+}
+
+// ReadErrorResponse reads an error-response packet
+func (r *Reader) ReadErrorResponse() (*ErrorResponse, error) {
+	b := make([]byte, ErrorResponseLen)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return nil, err
+	}
+	return DecodeErrorResponse(b)
+}
+
+// ReadFeedbackTuple reads a feedback tuple
+func (r *Reader) ReadFeedbackTuple() (*FeedbackTuple, error) {
+	b := make([]byte, FeedbackHeaderLen)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return nil, err
+	}
+
+	t := &FeedbackTuple{Time: binary.BigEndian.Uint32(b)}
+
+	token, err := r.read(nil, int(binary.BigEndian.Uint16(b[4:])))
+	if err != nil {
+		return nil, err
+	}
+	t.Token = token
+
+	return t, nil
+}
+
+// read appends n bytes to b. The frame started before, so io.EOF becomes
+// io.ErrUnexpectedEOF.
+func (r *Reader) read(b []byte, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return append(b, buf...), nil
+}
+
+// readItems appends count length-prefixed items to b
+func (r *Reader) readItems(b []byte, count int) ([]byte, error) {
+	var err error
+	for i := 0; i < count; i++ {
+		if b, err = r.read(b, 2); err != nil {
+			return nil, err
+		}
+		if b, err = r.read(b, int(binary.BigEndian.Uint16(b[len(b)-2:]))); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
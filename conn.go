@@ -2,21 +2,93 @@ package apns
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"time"
+
+	"github.com/mentionapp/apns.go/codec"
+	"golang.org/x/net/context"
+)
+
+// CloseReason tells why a connection to APNs was closed
+type CloseReason int
+
+// Known values of CloseReason
+const (
+	UnknownCloseReason CloseReason = iota
+	// ErrorResponseCloseReason means that APNs sent an error-response
+	ErrorResponseCloseReason
+	// EOFCloseReason means that APNs closed the connection without sending
+	// an error-response
+	EOFCloseReason
+	TimeoutCloseReason
+	// TLSAlertCloseReason means that APNs sent a TLS alert, e.g. because the
+	// certificate was revoked
+	TLSAlertCloseReason
+	// MalformedCloseReason means that the connection was closed in the middle
+	// of an error-response
+	MalformedCloseReason
+	// UnknownCommandCloseReason means that APNs sent a response with an
+	// unknown ErrorResponseCommand
+	UnknownCommandCloseReason
+	// LocalCloseReason means that the connection was closed by the Sender
+	LocalCloseReason
 )
 
+var closeReasonNames = map[CloseReason]string{
+	UnknownCloseReason:        "UNKNOWN",
+	ErrorResponseCloseReason:  "ERROR_RESPONSE",
+	EOFCloseReason:            "EOF",
+	TimeoutCloseReason:        "TIMEOUT",
+	TLSAlertCloseReason:       "TLS_ALERT",
+	MalformedCloseReason:      "MALFORMED",
+	UnknownCommandCloseReason: "UNKNOWN_COMMAND",
+	LocalCloseReason:          "LOCAL",
+}
+
+func (r CloseReason) String() string {
+	if s, ok := closeReasonNames[r]; ok {
+		return s
+	}
+	return "INVALID"
+}
+
+// ConnectionClosedError tells why a connection to APNs was closed
+type ConnectionClosedError struct {
+	Reason CloseReason
+	// Response is the error-response sent by APNs, if any
+	Response *ErrorResponse
+	Err      error
+}
+
+func (e *ConnectionClosedError) Error() string {
+	switch {
+	case e.Response != nil:
+		return fmt.Sprintf("connection closed (%v): %v", e.Reason, e.Response)
+	case e.Err != nil:
+		return fmt.Sprintf("connection closed (%v): %v", e.Reason, e.Err)
+	}
+	return fmt.Sprintf("connection closed (%v)", e.Reason)
+}
+
+func (e *ConnectionClosedError) Unwrap() error {
+	return e.Err
+}
+
 type conn interface {
 	Write(n *Notification) (connError bool, err error)
 	Read() <-chan *ErrorResponse
+	// Err returns why the connection was closed, once Read() has delivered
+	Err() *ConnectionClosedError
 	Done() <-chan struct{}
 	Close()
 	GetSentNotification(identifier NotificationIdentifier) *Notification
 	GetSentNotificationsAfter(identifier NotificationIdentifier) []*Notification
 	GetSentNotifications() []*Notification
 	Expire()
+	Queued() (count, bytes int)
 }
 
 type netConn struct {
@@ -24,39 +96,77 @@ type netConn struct {
 	sent  *queue
 	donec chan struct{}
 	readc chan *ErrorResponse
+	err   *ConnectionClosedError
 }
 
-func newTlsConn(addr string, cert *tls.Certificate) (conn net.Conn, err error) {
-	c, err := net.Dial("tcp", addr)
+func newTlsConn(ctx context.Context, addr string, cert *tls.Certificate, dc *dialConfig) (conn net.Conn, err error) {
+	var notAfter time.Time
+	if leaf, err := certificateLeaf(cert); err == nil {
+		notAfter = leaf.NotAfter
+		if time.Now().After(notAfter) {
+			return nil, &CertificateError{
+				Expired:  true,
+				NotAfter: notAfter,
+				Err:      fmt.Errorf("certificate expired on %v", notAfter.Format(time.RFC3339)),
+			}
+		}
+	}
+
+	name, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return
 	}
 
-	name, _, err := net.SplitHostPort(addr)
+	c, err := dc.dial(ctx, addr)
 	if err != nil {
 		return
 	}
 
-	tlsConf := &tls.Config{
-		Certificates: []tls.Certificate{*cert},
-		ServerName:   name,
+	if timeout := dc.getHandshakeTimeout(); timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
 	}
 
-	tlsConn := tls.Client(c, tlsConf)
+	tlsConn := tls.Client(c, dc.clientTLSConfig(name, cert))
 	if err = tlsConn.Handshake(); err != nil {
 		c.Close()
-		return
+		return nil, handshakeError(err, notAfter)
 	}
+
+	c.SetDeadline(time.Time{})
+
 	return tlsConn, nil
 }
 
+// handshakeError returns a *CertificateError if err is a TLS alert sent by the
+// server because of the client certificate
+func handshakeError(err error, notAfter time.Time) error {
+	opErr, ok := err.(*net.OpError)
+	if !ok || opErr.Op != "remote error" {
+		return err
+	}
+
+	certErr := &CertificateError{NotAfter: notAfter, Err: opErr.Err}
+
+	switch opErr.Err.Error() {
+	case "tls: certificate expired":
+		certErr.Expired = true
+	case "tls: certificate revoked":
+		certErr.Revoked = true
+	case "tls: bad certificate", "tls: certificate unknown", "tls: unsupported certificate", "tls: unknown certificate authority":
+	default:
+		return err
+	}
+
+	return certErr
+}
+
 // newConn creates a new conn instance
-func newConn(addr string, cert *tls.Certificate) (conn, error) {
-	tlsConn, err := newTlsConn(addr, cert)
+func newConn(addr string, cert *tls.Certificate, dc *dialConfig, qc queueConfig) (conn, error) {
+	tlsConn, err := newTlsConn(context.Background(), addr, cert, dc)
 	if err != nil {
 		return nil, err
 	}
-	q := newQueue(time.Second * 60)
+	q := newQueue(qc)
 
 	conn := &netConn{
 		conn:  tlsConn,
@@ -73,17 +183,17 @@ func newConn(addr string, cert *tls.Certificate) (conn, error) {
 func (c *netConn) Write(n *Notification) (connError bool, err error) {
 	payload, err := n.Encode()
 	if err != nil {
-		return false, fmt.Errorf("failed encoding notification %v: %v", n.Identifier(), err)
+		return false, fmt.Errorf("failed encoding notification %v: %w", n.Identifier(), err)
 	}
 
 	c.conn.SetWriteDeadline(time.Now().Add(time.Second * 60))
 	if l, err := c.conn.Write(payload); err != nil {
-		return true, fmt.Errorf("failed sending notification %v: %v", n.Identifier(), err)
+		return true, fmt.Errorf("failed sending notification %v: %w", n.Identifier(), err)
 	} else if l != len(payload) {
 		return true, fmt.Errorf("failed sending notification %v: wrote %v bytes, expected %v", n.Identifier(), l, len(payload))
 	}
 
-	c.sent.Add(n)
+	c.sent.Add(n, payload)
 
 	return false, nil
 }
@@ -92,6 +202,10 @@ func (c *netConn) Read() <-chan *ErrorResponse {
 	return c.readc
 }
 
+func (c *netConn) Err() *ConnectionClosedError {
+	return c.err
+}
+
 func (c *netConn) Done() <-chan struct{} {
 	return c.donec
 }
@@ -121,19 +235,50 @@ func (c *netConn) Expire() {
 	c.sent.Expire()
 }
 
+// Queued returns the number and size of the sent notifications kept in case of
+// an error-response
+func (c *netConn) Queued() (count, bytes int) {
+	return c.sent.Len()
+}
+
 func (c *netConn) read() {
-	var resp *ErrorResponse
-	var err error
+	buffer := make([]byte, codec.ErrorResponseLen)
+	_, err := io.ReadFull(c.conn, buffer)
 
-	buffer := make([]byte, errorResponseLen)
-	n, _ := c.conn.Read(buffer)
+	c.err = readError(buffer, err)
+	c.readc <- c.err.Response
+}
 
-	if n == len(buffer) {
-		resp, err = decodeErrorResponse(buffer)
-		if err != nil {
-			log.Printf("Failed decoding error-response: %v", err)
+// readError returns why the connection was closed after reading buffer
+func readError(buffer []byte, err error) *ConnectionClosedError {
+	if err == nil {
+		resp, _ := decodeErrorResponse(buffer)
+		if resp.Command != ErrorCommand {
+			return &ConnectionClosedError{
+				Reason: UnknownCommandCloseReason,
+				Err:    fmt.Errorf("unknown error-response command %v", resp.Command),
+			}
 		}
+		return &ConnectionClosedError{Reason: ErrorResponseCloseReason, Response: resp}
+	}
+
+	var opErr *net.OpError
+	var netErr net.Error
+
+	reason := UnknownCloseReason
+
+	switch {
+	case err == io.EOF:
+		reason = EOFCloseReason
+	case err == io.ErrUnexpectedEOF:
+		reason = MalformedCloseReason
+	case errors.Is(err, net.ErrClosed):
+		reason = LocalCloseReason
+	case errors.As(err, &opErr) && opErr.Op == "remote error":
+		reason = TLSAlertCloseReason
+	case errors.As(err, &netErr) && netErr.Timeout():
+		reason = TimeoutCloseReason
 	}
 
-	c.readc <- resp
+	return &ConnectionClosedError{Reason: reason, Err: err}
 }
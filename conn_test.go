@@ -0,0 +1,82 @@
+package apns
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readResponse returns what netConn.read reports after APNs sent chunks and
+// closed the connection
+func readResponse(t *testing.T, chunks ...[]byte) (*ErrorResponse, *ConnectionClosedError) {
+
+	client, server := net.Pipe()
+
+	c := &netConn{
+		conn:  client,
+		donec: make(chan struct{}),
+		readc: make(chan *ErrorResponse, 1),
+	}
+
+	go c.read()
+
+	go func() {
+		for _, chunk := range chunks {
+			server.Write(chunk)
+		}
+		server.Close()
+	}()
+
+	select {
+	case resp := <-c.Read():
+		return resp, c.Err()
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the error-response")
+	}
+
+	return nil, nil
+}
+
+func TestNetConnReadsErrorResponses(t *testing.T) {
+
+	resp, err := readResponse(t, []byte{8, 8, 0}, []byte{0, 0, 42})
+	require.NotNil(t, resp)
+	assert.Equal(t, &ErrorResponse{Command: ErrorCommand, Status: InvalidTokenErrorStatus, Identifier: 42}, resp)
+	assert.Equal(t, ErrorResponseCloseReason, err.Reason)
+
+	resp, err = readResponse(t)
+	assert.Nil(t, resp)
+	assert.Equal(t, EOFCloseReason, err.Reason)
+
+	resp, err = readResponse(t, []byte{8, 8, 0})
+	assert.Nil(t, resp)
+	assert.Equal(t, MalformedCloseReason, err.Reason)
+
+	resp, err = readResponse(t, []byte{9, 8, 0, 0, 0, 42})
+	assert.Nil(t, resp)
+	assert.Equal(t, UnknownCommandCloseReason, err.Reason)
+}
+
+func TestReadErrorReasons(t *testing.T) {
+
+	alert := &net.OpError{Op: "remote error", Err: errors.New("tls: certificate revoked")}
+	assert.Equal(t, TLSAlertCloseReason, readError(nil, alert).Reason)
+
+	timeout := &net.OpError{Op: "read", Err: timeoutError{}}
+	assert.Equal(t, TimeoutCloseReason, readError(nil, timeout).Reason)
+
+	closed := &net.OpError{Op: "read", Err: net.ErrClosed}
+	assert.Equal(t, LocalCloseReason, readError(nil, closed).Reason)
+
+	assert.Equal(t, UnknownCloseReason, readError(nil, errors.New("some error")).Reason)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,96 @@
+package apns
+
+// ErrorClass tells how an error reported by APNs should be handled
+type ErrorClass int
+
+// Values of ErrorClass
+const (
+	// UnknownErrorClass is for errors that could not be classified
+	UnknownErrorClass ErrorClass = iota
+	// RetryableErrorClass is for transient errors: sending the notification
+	// again may succeed
+	RetryableErrorClass
+	// PermanentTokenErrorClass is for errors caused by the device token. The
+	// token should not be used anymore.
+	PermanentTokenErrorClass
+	// PermanentPayloadErrorClass is for errors caused by the notification
+	// itself (payload, expiry, priority...)
+	PermanentPayloadErrorClass
+	// FatalConfigErrorClass is for errors caused by the configuration of the
+	// sender (certificate, topic...), that affect all notifications
+	FatalConfigErrorClass
+)
+
+var errorClassNames = map[ErrorClass]string{
+	UnknownErrorClass:          "UNKNOWN",
+	RetryableErrorClass:        "RETRYABLE",
+	PermanentTokenErrorClass:   "PERMANENT_TOKEN",
+	PermanentPayloadErrorClass: "PERMANENT_PAYLOAD",
+	FatalConfigErrorClass:      "FATAL_CONFIG",
+}
+
+func (c ErrorClass) String() string {
+	if s, ok := errorClassNames[c]; ok {
+		return s
+	}
+	return "INVALID"
+}
+
+var errorResponseStatusClasses = map[ErrorResponseStatus]ErrorClass{
+	ProcessingErrorStatus:         RetryableErrorClass,
+	MissingDeviceTokenErrorStatus: PermanentTokenErrorClass,
+	MissingTopicErrorStatus:       FatalConfigErrorClass,
+	MissingPayloadErrorStatus:     PermanentPayloadErrorClass,
+	InvalidTokenSizeErrorStatus:   PermanentTokenErrorClass,
+	InvalidTopicSizeErrorStatus:   FatalConfigErrorClass,
+	InvalidPayloadSizeErrorStatus: PermanentPayloadErrorClass,
+	InvalidTokenErrorStatus:       PermanentTokenErrorClass,
+	ShutdownErrorStatus:           RetryableErrorClass,
+	UnknownErrorStatus:            RetryableErrorClass,
+}
+
+// Class returns the ErrorClass of the status
+func (e ErrorResponseStatus) Class() ErrorClass {
+	return errorResponseStatusClasses[e]
+}
+
+// reasonClasses maps the reasons returned by the HTTP/2 APNs API to their
+// ErrorClass
+var reasonClasses = map[string]ErrorClass{
+	"BadCollapseId":               PermanentPayloadErrorClass,
+	"BadDeviceToken":              PermanentTokenErrorClass,
+	"BadExpirationDate":           PermanentPayloadErrorClass,
+	"BadMessageId":                PermanentPayloadErrorClass,
+	"BadPriority":                 PermanentPayloadErrorClass,
+	"BadTopic":                    FatalConfigErrorClass,
+	"DeviceTokenNotForTopic":      PermanentTokenErrorClass,
+	"DuplicateHeaders":            PermanentPayloadErrorClass,
+	"IdleTimeout":                 RetryableErrorClass,
+	"InvalidPushType":             PermanentPayloadErrorClass,
+	"MissingDeviceToken":          PermanentTokenErrorClass,
+	"MissingTopic":                FatalConfigErrorClass,
+	"PayloadEmpty":                PermanentPayloadErrorClass,
+	"TopicDisallowed":             FatalConfigErrorClass,
+	"BadCertificate":              FatalConfigErrorClass,
+	"BadCertificateEnvironment":   FatalConfigErrorClass,
+	"ExpiredProviderToken":        FatalConfigErrorClass,
+	"Forbidden":                   FatalConfigErrorClass,
+	"InvalidProviderToken":        FatalConfigErrorClass,
+	"MissingProviderToken":        FatalConfigErrorClass,
+	"BadPath":                     FatalConfigErrorClass,
+	"MethodNotAllowed":            FatalConfigErrorClass,
+	"ExpiredToken":                PermanentTokenErrorClass,
+	"Unregistered":                PermanentTokenErrorClass,
+	"PayloadTooLarge":             PermanentPayloadErrorClass,
+	"TooManyProviderTokenUpdates": RetryableErrorClass,
+	"TooManyRequests":             RetryableErrorClass,
+	"InternalServerError":         RetryableErrorClass,
+	"ServiceUnavailable":          RetryableErrorClass,
+	"Shutdown":                    RetryableErrorClass,
+}
+
+// ClassifyReason returns the ErrorClass of a reason returned by the HTTP/2
+// APNs API (e.g. "BadDeviceToken")
+func ClassifyReason(reason string) ErrorClass {
+	return reasonClasses[reason]
+}
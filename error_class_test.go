@@ -0,0 +1,30 @@
+package apns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorResponseStatusClass(t *testing.T) {
+	assert.Equal(t, RetryableErrorClass, ProcessingErrorStatus.Class())
+	assert.Equal(t, RetryableErrorClass, UnknownErrorStatus.Class())
+	assert.Equal(t, PermanentTokenErrorClass, InvalidTokenErrorStatus.Class())
+	assert.Equal(t, PermanentPayloadErrorClass, InvalidPayloadSizeErrorStatus.Class())
+	assert.Equal(t, FatalConfigErrorClass, MissingTopicErrorStatus.Class())
+	assert.Equal(t, UnknownErrorClass, ErrorResponseStatus(42).Class())
+}
+
+func TestClassifyReason(t *testing.T) {
+	assert.Equal(t, PermanentTokenErrorClass, ClassifyReason("Unregistered"))
+	assert.Equal(t, PermanentPayloadErrorClass, ClassifyReason("PayloadTooLarge"))
+	assert.Equal(t, FatalConfigErrorClass, ClassifyReason("BadCertificateEnvironment"))
+	assert.Equal(t, RetryableErrorClass, ClassifyReason("TooManyRequests"))
+	assert.Equal(t, UnknownErrorClass, ClassifyReason("SomethingNew"))
+}
+
+func TestSenderErrorClass(t *testing.T) {
+	assert.Equal(t, PermanentTokenErrorClass, (&SenderError{ErrorResponse: &ErrorResponse{Status: InvalidTokenErrorStatus}}).Class())
+	assert.Equal(t, FatalConfigErrorClass, (&SenderError{Err: &CertificateError{}}).Class())
+	assert.Equal(t, RetryableErrorClass, (&SenderError{Err: &RetryError{}}).Class())
+}
@@ -1,8 +1,10 @@
 package apns
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
+
+	"github.com/mentionapp/apns.go/codec"
 )
 
 // ErrorResponseCommand represents the Command field of error-response packets
@@ -38,8 +40,6 @@ const (
 	UnknownErrorStatus            ErrorResponseStatus = 255
 )
 
-const errorResponseLen = 6
-
 var errorResponseStatusNames = map[ErrorResponseStatus]string{
 	NoErrorsStatus:                "NO_ERRORS",
 	ProcessingErrorStatus:         "PROCESSING_ERROR",
@@ -61,17 +61,52 @@ func (e ErrorResponseStatus) String() string {
 	return "INVALID"
 }
 
-func decodeErrorResponse(r []byte) (*ErrorResponse, error) {
+// Errors matching ErrorResponses with errors.Is, one per ErrorResponseStatus
+var (
+	ErrProcessing         = errors.New("apns: processing error")
+	ErrMissingDeviceToken = errors.New("apns: missing device token")
+	ErrMissingTopic       = errors.New("apns: missing topic")
+	ErrMissingPayload     = errors.New("apns: missing payload")
+	ErrInvalidTokenSize   = errors.New("apns: invalid token size")
+	ErrInvalidTopicSize   = errors.New("apns: invalid topic size")
+	ErrInvalidPayloadSize = errors.New("apns: invalid payload size")
+	ErrInvalidToken       = errors.New("apns: invalid token")
+	ErrShutdown           = errors.New("apns: shutdown")
+	ErrUnknown            = errors.New("apns: unknown error")
+)
 
-	if len(r) != errorResponseLen {
-		return nil, fmt.Errorf("invalid buffer length: expected %v bytes, got %v", errorResponseLen, len(r))
-	}
+var errorResponseStatusErrors = map[ErrorResponseStatus]error{
+	ProcessingErrorStatus:         ErrProcessing,
+	MissingDeviceTokenErrorStatus: ErrMissingDeviceToken,
+	MissingTopicErrorStatus:       ErrMissingTopic,
+	MissingPayloadErrorStatus:     ErrMissingPayload,
+	InvalidTokenSizeErrorStatus:   ErrInvalidTokenSize,
+	InvalidTopicSizeErrorStatus:   ErrInvalidTopicSize,
+	InvalidPayloadSizeErrorStatus: ErrInvalidPayloadSize,
+	InvalidTokenErrorStatus:       ErrInvalidToken,
+	ShutdownErrorStatus:           ErrShutdown,
+	UnknownErrorStatus:            ErrUnknown,
+}
 
-	er := &ErrorResponse{
-		Command:    ErrorResponseCommand(r[0]),
-		Status:     ErrorResponseStatus(r[1]),
-		Identifier: NotificationIdentifier(binary.BigEndian.Uint32(r[2:])),
+func (e *ErrorResponse) Error() string {
+	return fmt.Sprintf("apns: error-response %v for notification %v", e.Status, e.Identifier)
+}
+
+// Is reports whether target is the error of e.Status, e.g. ErrInvalidToken
+func (e *ErrorResponse) Is(target error) bool {
+	err, ok := errorResponseStatusErrors[e.Status]
+	return ok && err == target
+}
+
+func decodeErrorResponse(r []byte) (*ErrorResponse, error) {
+	resp, err := codec.DecodeErrorResponse(r)
+	if err != nil {
+		return nil, err
 	}
 
-	return er, nil
+	return &ErrorResponse{
+		Command:    ErrorResponseCommand(resp.Command),
+		Status:     ErrorResponseStatus(resp.Status),
+		Identifier: NotificationIdentifier(resp.Identifier),
+	}, nil
 }
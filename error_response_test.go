@@ -0,0 +1,76 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorResponseIs(t *testing.T) {
+
+	resp := &ErrorResponse{Command: ErrorCommand, Status: InvalidTokenErrorStatus, Identifier: 3}
+
+	assert.True(t, errors.Is(resp, ErrInvalidToken))
+	assert.False(t, errors.Is(resp, ErrInvalidTokenSize))
+
+	n := NewNotification()
+	n.SetIdentifier(3)
+
+	err := fmt.Errorf("wrapped: %w", &SenderError{Notification: n, ErrorResponse: resp})
+
+	assert.True(t, errors.Is(err, ErrInvalidToken))
+
+	var r *ErrorResponse
+	if assert.True(t, errors.As(err, &r)) {
+		assert.Equal(t, NotificationIdentifier(3), r.Identifier)
+	}
+}
+
+func TestSenderErrorUnwrapsErr(t *testing.T) {
+
+	n := NewNotification()
+	n.SetIdentifier(1)
+
+	err := error(&SenderError{Notification: n, Err: &RetryError{Attempts: 2, Err: ErrProcessing}})
+
+	var retryErr *RetryError
+	assert.True(t, errors.As(err, &retryErr))
+	assert.True(t, errors.Is(err, ErrProcessing))
+}
+
+func TestEncodeErrors(t *testing.T) {
+
+	n := NewNotification()
+	n.SetIdentifier(1)
+	n.SetDeviceToken("not hex")
+
+	_, err := n.Encode()
+	var tokenErr *InvalidTokenError
+	if assert.True(t, errors.As(err, &tokenErr)) {
+		assert.Equal(t, "not hex", tokenErr.Token)
+	}
+
+	n.SetDeviceToken("0000000000000000000000000000000000000000000000000000000000000001")
+	payload := Payload{}
+	payload.SetAlertString(strings.Repeat("x", MaxPayloadLen))
+	n.SetPayload(payload)
+
+	_, err = n.Encode()
+	var payloadErr *PayloadTooLargeError
+	if assert.True(t, errors.As(err, &payloadErr)) {
+		assert.Equal(t, MaxPayloadLen, payloadErr.Max)
+		assert.True(t, payloadErr.Size > MaxPayloadLen)
+	}
+
+	n = NewNotification()
+	_, err = n.Encode()
+	assert.Equal(t, ErrNoIdentifier, err)
+
+	n.SetIdentifier(1)
+	n.SetDeviceToken(strings.Repeat("00", 1<<16))
+	_, err = n.Encode()
+	assert.True(t, errors.As(err, &tokenErr))
+}
@@ -0,0 +1,138 @@
+package apns
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SenderEventType identifies the kind of a SenderEvent
+type SenderEventType int
+
+// Known values of SenderEventType
+const (
+	// CertificateExpiringEvent is emitted when the certificate expires in less
+	// than one of the SenderCertificateExpiryThresholds
+	CertificateExpiringEvent SenderEventType = iota + 1
+	// CertificateExpiredEvent is emitted when the certificate has expired
+	CertificateExpiredEvent
+	// CertificateRejectedEvent is emitted when a connection fails because of
+	// the certificate. Err is a *CertificateError.
+	CertificateRejectedEvent
+	// NotificationExpiredEvent is emitted when Notification expired before it
+	// could be written. It is also reported as a SenderError with ErrExpired.
+	NotificationExpiredEvent
+	// ConnectionClosedEvent is emitted when APNs closes a connection without
+	// sending an error-response. It is not emitted for the connections closed
+	// by the Sender itself. Err is a *ConnectionClosedError.
+	ConnectionClosedEvent
+	// PausedEvent is emitted when Sender.Pause is called
+	PausedEvent
+	// ResumedEvent is emitted when Sender.Resume is called
+	ResumedEvent
+)
+
+var senderEventTypeNames = map[SenderEventType]string{
+	CertificateExpiringEvent: "CERTIFICATE_EXPIRING",
+	CertificateExpiredEvent:  "CERTIFICATE_EXPIRED",
+	CertificateRejectedEvent: "CERTIFICATE_REJECTED",
+	NotificationExpiredEvent: "NOTIFICATION_EXPIRED",
+	ConnectionClosedEvent:    "CONNECTION_CLOSED",
+	PausedEvent:              "PAUSED",
+	ResumedEvent:             "RESUMED",
+}
+
+func (t SenderEventType) String() string {
+	if s, ok := senderEventTypeNames[t]; ok {
+		return s
+	}
+	return "INVALID"
+}
+
+// SenderEvent reports a change in the state of a Sender
+type SenderEvent struct {
+	Type SenderEventType
+	Time time.Time
+	// NotAfter is the expiry of the certificate, for certificate events
+	NotAfter time.Time
+	// Notification is the notification concerned by notification events
+	Notification *Notification
+	Err          error
+}
+
+func (e *SenderEvent) String() string {
+	s := e.Type.String()
+	if !e.NotAfter.IsZero() {
+		s += fmt.Sprintf(" (certificate expires on %v)", e.NotAfter.Format(time.RFC3339))
+	}
+	if e.Notification != nil {
+		s += fmt.Sprintf(" (notification %v)", e.Notification.Identifier())
+	}
+	if e.Err != nil {
+		s += fmt.Sprintf(": %v", e.Err)
+	}
+	return s
+}
+
+// dispatcher calls a function with queued values from its own goroutine, so
+// that a slow function never blocks the caller of Push. With a limit, the
+// oldest values are dropped when the queue is full, and passed to drop.
+type dispatcher struct {
+	mu     sync.Mutex
+	queue  []interface{}
+	wakec  chan struct{}
+	handle func(v interface{})
+	limit  int
+	drop   func(v interface{})
+}
+
+func newDispatcher(handle func(v interface{})) *dispatcher {
+	d := &dispatcher{
+		wakec:  make(chan struct{}, 1),
+		handle: handle,
+	}
+	go d.run()
+	return d
+}
+
+func (d *dispatcher) Push(v interface{}) {
+	var dropped interface{}
+
+	d.mu.Lock()
+	if d.limit > 0 && v != nil && len(d.queue) >= d.limit {
+		dropped = d.queue[0]
+		d.queue = d.queue[1:]
+	}
+	d.queue = append(d.queue, v)
+	d.mu.Unlock()
+
+	if dropped != nil && d.drop != nil {
+		d.drop(dropped)
+	}
+
+	select {
+	case d.wakec <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops the dispatcher once the queued values have been handled
+func (d *dispatcher) Close() {
+	d.Push(nil)
+}
+
+func (d *dispatcher) run() {
+	for range d.wakec {
+		d.mu.Lock()
+		queue := d.queue
+		d.queue = nil
+		d.mu.Unlock()
+
+		for _, v := range queue {
+			if v == nil {
+				return
+			}
+			d.handle(v)
+		}
+	}
+}
@@ -2,12 +2,12 @@ package apns
 
 import (
 	"crypto/tls"
-	"encoding/binary"
 	"encoding/hex"
 	"io"
-	"strings"
 	"time"
 
+	"github.com/cenkalti/backoff"
+	"github.com/mentionapp/apns.go/codec"
 	"golang.org/x/net/context"
 )
 
@@ -17,7 +17,8 @@ const (
 )
 
 const (
-	feedbackCheckPeriod time.Duration = 5 * time.Second
+	defaultFeedbackPollInterval time.Duration = 5 * time.Second
+	defaultFeedbackMaxBackoff   time.Duration = 5 * time.Minute
 )
 
 type FeedbackMessage struct {
@@ -27,89 +28,213 @@ type FeedbackMessage struct {
 
 // Feedback only read binary apple socket
 type Feedback struct {
-	addr     string
-	cert     *tls.Certificate
-	messages chan *FeedbackMessage
+	addr         string
+	cert         *tls.Certificate
+	pollInterval time.Duration
+	maxBackoff   time.Duration
+	dial         dialConfig
+	messages     chan *FeedbackMessage
+	errorc       chan error
+	donec        chan struct{}
 }
 
-func NewFeedback(ctx context.Context, addr string, cert *tls.Certificate) (f *Feedback) {
-	f = &Feedback{
-		addr:     addr,
-		cert:     cert,
-		messages: make(chan *FeedbackMessage),
+// FeedbackOption configures a Feedback
+type FeedbackOption func(f *Feedback)
+
+// FeedbackPollInterval sets the delay between two connections to the feedback
+// service. The default is 5 seconds.
+func FeedbackPollInterval(d time.Duration) FeedbackOption {
+	return func(f *Feedback) {
+		f.pollInterval = d
+	}
+}
+
+// FeedbackMaxBackoff sets the maximum delay between two connections when the
+// feedback service can not be reached. The delay grows exponentially from the
+// poll interval up to this value. The default is 5 minutes.
+func FeedbackMaxBackoff(d time.Duration) FeedbackOption {
+	return func(f *Feedback) {
+		f.maxBackoff = d
+	}
+}
+
+// FeedbackTLSConfig sets the TLS configuration used to connect to the feedback
+// service, e.g. to trust custom root CAs or to require a minimum TLS version.
+// The client certificate is always the one passed to NewFeedback.
+func FeedbackTLSConfig(conf *tls.Config) FeedbackOption {
+	return func(f *Feedback) {
+		f.dial.tlsConfig = conf
+	}
+}
+
+// FeedbackDialer sets the Dialer used to connect to the feedback service, e.g.
+// a proxy Dialer created with NewProxyDialer
+func FeedbackDialer(d Dialer) FeedbackOption {
+	return func(f *Feedback) {
+		f.dial.dialer = d
+	}
+}
+
+// FeedbackTimeouts sets the timeouts of the TCP connection and of the TLS
+// handshake with the feedback service. Zero keeps the default of 30 seconds; a
+// negative value disables the timeout.
+func FeedbackTimeouts(dial, handshake time.Duration) FeedbackOption {
+	return func(f *Feedback) {
+		f.dial.dialTimeout = dial
+		f.dial.handshakeTimeout = handshake
 	}
+}
+
+// NewFeedback creates a new Feedback and starts polling the feedback service
+// until ctx is done.
+func NewFeedback(ctx context.Context, addr string, cert *tls.Certificate, opts ...FeedbackOption) *Feedback {
+	f := newFeedback(addr, cert, opts)
 	go f.reader(ctx)
-	return
+	return f
 }
 
+func newFeedback(addr string, cert *tls.Certificate, opts []FeedbackOption) *Feedback {
+	f := &Feedback{
+		addr:         addr,
+		cert:         cert,
+		pollInterval: defaultFeedbackPollInterval,
+		maxBackoff:   defaultFeedbackMaxBackoff,
+		messages:     make(chan *FeedbackMessage),
+		errorc:       make(chan error, 1),
+		donec:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// Messages returns the channel from which to receive FeedbackMessages. The
+// channel is closed once the Feedback has terminated.
 func (f *Feedback) Messages() <-chan *FeedbackMessage {
 	return f.messages
 }
 
+// Errors returns the channel from which to receive connection errors. Errors
+// are dropped if the channel is not read. The channel is closed once the
+// Feedback has terminated.
+func (f *Feedback) Errors() <-chan error {
+	return f.errorc
+}
+
+// Done returns a channel that's closed when this Feedback has terminated
+// (after ctx.Done() has been closed).
+func (f *Feedback) Done() <-chan struct{} {
+	return f.donec
+}
+
 func (f *Feedback) reader(ctx context.Context) {
-	var stop bool
-	go func() {
-		for {
+	defer func() {
+		close(f.messages)
+		close(f.errorc)
+		close(f.donec)
+	}()
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = f.pollInterval
+	b.MaxInterval = f.maxBackoff
+	b.MaxElapsedTime = 0
+	b.Reset()
+
+	for {
+		delay := f.pollInterval
+
+		result, err := f.Fetch(ctx)
+		for _, msg := range result {
+			info("Feedback receive msg: %v", msg)
 			select {
+			case f.messages <- msg:
 			case <-ctx.Done():
-				stop = true
 				return
 			}
 		}
-	}()
-	for {
-		if stop {
-			break
+
+		if ctx.Err() != nil {
+			return
 		}
-		result, err := f.receive()
-		if err != nil && err != io.EOF {
+
+		if err != nil {
 			info("Feedback receive err: %v", err)
-		} else {
-			for _, msg := range result {
-				info("Feedback receive msg: %v", msg)
-				f.messages <- msg
+			select {
+			case f.errorc <- err:
+			default:
 			}
+			delay = b.NextBackOff()
+		} else {
+			b.Reset()
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
 		}
-		time.Sleep(feedbackCheckPeriod)
 	}
 }
 
-func (f *Feedback) receive() (result []*FeedbackMessage, err error) {
+// FetchFeedback connects once to the feedback service at addr and returns the
+// messages it sent before closing the connection.
+func FetchFeedback(ctx context.Context, addr string, cert *tls.Certificate, opts ...FeedbackOption) ([]*FeedbackMessage, error) {
+	return newFeedback(addr, cert, opts).Fetch(ctx)
+}
+
+// Fetch connects once to the feedback service and returns the messages it
+// sent before closing the connection. Cancelling ctx aborts the connection;
+// the messages received so far are returned along with ctx.Err().
+func (f *Feedback) Fetch(ctx context.Context) ([]*FeedbackMessage, error) {
+	result, err := f.receive(ctx)
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return result, err
+}
+
+func (f *Feedback) receive(ctx context.Context) (result []*FeedbackMessage, err error) {
 	info("Connecting to %v", f.addr)
-	conn, err := newTlsConn(f.addr, f.cert)
+	conn, err := newTlsConn(ctx, f.addr, f.cert, &f.dial)
 	if err != nil {
-		info("Failed connecting to %v: %v; will retry", f.addr, err)
+		info("Failed connecting to %v: %v", f.addr, err)
 		return
 	}
 	info("Connected to %v", f.addr)
 	defer conn.Close()
 
+	donec := make(chan struct{})
+	defer close(donec)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-donec:
+		}
+	}()
+
+	return readFeedbackMessages(conn)
+}
+
+// readFeedbackMessages reads feedback tuples from r until an error occurs.
+// io.EOF is returned when r ends cleanly between two tuples.
+func readFeedbackMessages(r io.Reader) (result []*FeedbackMessage, err error) {
 	result = make([]*FeedbackMessage, 0, 1)
+	cr := codec.NewReader(r)
 	for {
-		var unsubTime uint32
-		var tokenLen uint16
-		if err = binary.Read(conn, binary.BigEndian, &unsubTime); err != nil {
-			return result, err
-		}
-		if err = binary.Read(conn, binary.BigEndian, &tokenLen); err != nil {
+		var t *codec.FeedbackTuple
+		if t, err = cr.ReadFeedbackTuple(); err != nil {
 			return result, err
 		}
-		bToken := make([]byte, int(tokenLen))
-		n, err := io.ReadFull(conn, bToken)
-		if err != nil {
-			return result, err
-		}
-		if n != int(tokenLen) {
-			return result, err
-		}
-
-		token := hex.EncodeToString(bToken)
-		token = strings.ToLower(token)
 
 		result = append(result, &FeedbackMessage{
-			Unsubscribe: time.Unix(int64(unsubTime), 0),
-			DeviceToken: token,
+			Unsubscribe: time.Unix(int64(t.Time), 0),
+			DeviceToken: hex.EncodeToString(t.Token),
 		})
 	}
-
 }
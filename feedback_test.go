@@ -0,0 +1,101 @@
+package apns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFeedbackTuple(buf *bytes.Buffer, unsub uint32, token string) {
+	b, _ := hex.DecodeString(token)
+	binary.Write(buf, binary.BigEndian, unsub)
+	binary.Write(buf, binary.BigEndian, uint16(len(b)))
+	buf.Write(b)
+}
+
+func TestReadFeedbackMessages(t *testing.T) {
+
+	t1 := "ABCDEF0123456789abcdef0123456789abcdef0123456789abcdef0123456789"
+	t2 := "0000000000000000000000000000000000000000000000000000000000000001"
+
+	buf := &bytes.Buffer{}
+	writeFeedbackTuple(buf, 1400000000, t1)
+	writeFeedbackTuple(buf, 1400000001, t2)
+
+	msgs, err := readFeedbackMessages(buf)
+
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []*FeedbackMessage{
+		{Unsubscribe: time.Unix(1400000000, 0), DeviceToken: "abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789"},
+		{Unsubscribe: time.Unix(1400000001, 0), DeviceToken: t2},
+	}, msgs)
+}
+
+func TestReadFeedbackMessagesWithLongerTokens(t *testing.T) {
+
+	t1 := strings.Repeat("ab", 32)
+	t2 := strings.Repeat("cd", 100)
+	t3 := strings.Repeat("ef", 32)
+
+	buf := &bytes.Buffer{}
+	writeFeedbackTuple(buf, 1400000000, t1)
+	writeFeedbackTuple(buf, 1400000001, t2)
+	writeFeedbackTuple(buf, 1400000002, t3)
+
+	msgs, err := readFeedbackMessages(buf)
+
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []*FeedbackMessage{
+		{Unsubscribe: time.Unix(1400000000, 0), DeviceToken: t1},
+		{Unsubscribe: time.Unix(1400000001, 0), DeviceToken: t2},
+		{Unsubscribe: time.Unix(1400000002, 0), DeviceToken: t3},
+	}, msgs)
+}
+
+func TestReadFeedbackMessagesTruncated(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+	writeFeedbackTuple(buf, 1400000000, "0000000000000000000000000000000000000000000000000000000000000001")
+	buf.Truncate(buf.Len() - 1)
+
+	msgs, err := readFeedbackMessages(buf)
+
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Empty(t, msgs)
+}
+
+func TestFeedbackReportsErrorsAndStops(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	f := NewFeedback(ctx, "127.0.0.1:1", &tls.Certificate{},
+		FeedbackPollInterval(time.Millisecond*10),
+		FeedbackMaxBackoff(time.Millisecond*20))
+
+	select {
+	case err := <-f.Errors():
+		assert.NotNil(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for a connection error")
+	}
+
+	cancel()
+
+	select {
+	case <-f.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for Feedback to terminate")
+	}
+
+	_, ok := <-f.Messages()
+	assert.False(t, ok)
+}
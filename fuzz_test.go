@@ -0,0 +1,83 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func FuzzNotificationEncode(f *testing.F) {
+
+	f.Add("0000000000000000000000000000000000000000000000000000000000000001", []byte(`{"aps":{}}`), uint32(1), int64(0), uint8(10))
+	f.Add("abcdef", []byte(`{}`), uint32(0), int64(1400000000), uint8(5))
+	f.Add("not hex", []byte{}, uint32(0), int64(-1), uint8(0))
+
+	f.Fuzz(func(t *testing.T, token string, payload []byte, id uint32, expiry int64, priority uint8) {
+		n := NewNotification()
+		n.SetDeviceToken(token)
+		n.SetPayload(RawPayload(payload))
+		n.SetIdentifier(NotificationIdentifier(id))
+		if expiry != 0 {
+			n.SetExpiry(time.Unix(expiry, 0))
+		}
+		n.SetPriority(NotificationPriority(priority))
+
+		b, err := n.Encode()
+		if err != nil {
+			return
+		}
+
+		decoded, err := decodeNotification(b)
+		if err != nil {
+			t.Fatalf("failed decoding encoded notification: %v", err)
+		}
+
+		raw, _ := hex.DecodeString(token)
+		if decoded.DeviceToken() != hex.EncodeToString(raw) {
+			t.Fatalf("token %q decoded as %q", token, decoded.DeviceToken())
+		}
+		if p, _ := decoded.Payload().Bytes(); !bytes.Equal(p, payload) {
+			t.Fatalf("payload %q decoded as %q", payload, p)
+		}
+		if decoded.Identifier() != n.Identifier() || decoded.Priority() != n.Priority() {
+			t.Fatalf("round trip changed %+v to %+v", n, decoded)
+		}
+	})
+}
+
+func FuzzReadFeedbackMessages(f *testing.F) {
+
+	buf := &bytes.Buffer{}
+	writeFeedbackTuple(buf, 1400000000, "0000000000000000000000000000000000000000000000000000000000000001")
+	f.Add(buf.Bytes())
+	f.Add([]byte{0, 0, 0, 1, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msgs, err := readFeedbackMessages(bytes.NewReader(b))
+		if err == nil {
+			t.Fatal("expected an error at the end of the stream")
+		}
+		for _, msg := range msgs {
+			if _, err := hex.DecodeString(msg.DeviceToken); err != nil {
+				t.Fatalf("invalid token %q: %v", msg.DeviceToken, err)
+			}
+		}
+	})
+}
+
+func FuzzDecodeErrorResponse(f *testing.F) {
+
+	f.Add([]byte{8, 8, 0, 0, 0, 1})
+	f.Add([]byte{9, 0, 0})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		resp, err := decodeErrorResponse(b)
+		if (err == nil) != (len(b) == 6) {
+			t.Fatalf("decoding %v: %v", b, err)
+		}
+		if err == nil && readError(b, nil).Response == nil && resp.Command == ErrorCommand {
+			t.Fatalf("error-response %v was not reported", resp)
+		}
+	})
+}
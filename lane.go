@@ -0,0 +1,150 @@
+package apns
+
+import "errors"
+
+// Lane is a priority class of notifications. Notifications sent to a higher
+// priority lane are written first; notifications requeued after an error
+// are always written before any lane.
+type Lane int
+
+// Known values of Lane, from the highest priority to the lowest
+const (
+	// TransactionalLane is for notifications that users wait for, e.g. login
+	// codes
+	TransactionalLane Lane = iota
+	// NormalLane is the lane of Sender.Notifications()
+	NormalLane
+	// BulkLane is for broadcasts to many devices
+	BulkLane
+	laneCount
+)
+
+// ErrInvalidLane is returned by TrySendLane for a lane that is not one of the
+// known values of Lane
+var ErrInvalidLane = errors.New("apns: invalid lane")
+
+var laneNames = map[Lane]string{
+	TransactionalLane: "TRANSACTIONAL",
+	NormalLane:        "NORMAL",
+	BulkLane:          "BULK",
+}
+
+func (l Lane) String() string {
+	if s, ok := laneNames[l]; ok {
+		return s
+	}
+	return "INVALID"
+}
+
+// valid returns whether l is one of the known values of Lane
+func (l Lane) valid() bool {
+	return l >= 0 && l < laneCount
+}
+
+// SenderLaneWeights makes the Sender alternate between lanes: out of
+// transactional+normal+bulk notifications taken while all lanes are busy,
+// each lane gets its weight. Weights lower than 1 count as 1. By default,
+// lanes are strictly ordered: a lane is only read when the higher priority
+// lanes are empty.
+func SenderLaneWeights(transactional, normal, bulk int) SenderOption {
+	return func(s *Sender) {
+		s.lanes.weights = []int{transactional, normal, bulk}
+		for i, w := range s.lanes.weights {
+			if w < 1 {
+				s.lanes.weights[i] = 1
+			}
+		}
+	}
+}
+
+// lanes schedules the notifications of the lanes of a Sender
+type lanes struct {
+	chans [laneCount]chan *Notification
+	// weights are nil for strict scheduling
+	weights []int
+	credits [laneCount]int
+}
+
+// next returns the next notification to send, or nil once stopc or donec are
+// closed
+func (l *lanes) next(stopc, donec <-chan struct{}) *Notification {
+	select {
+	case <-stopc:
+		return nil
+	case <-donec:
+		return nil
+	default:
+	}
+
+	if n := l.poll(); n != nil {
+		return n
+	}
+
+	select {
+	case n := <-l.chans[TransactionalLane]:
+		l.take(TransactionalLane)
+		return n
+	case n := <-l.chans[NormalLane]:
+		l.take(NormalLane)
+		return n
+	case n := <-l.chans[BulkLane]:
+		l.take(BulkLane)
+		return n
+	case <-stopc:
+	case <-donec:
+	}
+
+	return nil
+}
+
+// poll returns the next notification of the highest priority lane that has
+// one and, with weights, credits left. Credits are reset when exhausted.
+func (l *lanes) poll() *Notification {
+	for pass := 0; pass < 2; pass++ {
+		for lane, c := range l.chans {
+			if l.weights != nil && l.credits[lane] <= 0 {
+				continue
+			}
+			select {
+			case n := <-c:
+				l.take(Lane(lane))
+				return n
+			default:
+			}
+		}
+
+		if l.weights == nil {
+			break
+		}
+		copy(l.credits[:], l.weights)
+	}
+
+	return nil
+}
+
+func (l *lanes) take(lane Lane) {
+	if l.weights != nil && l.credits[lane] > 0 {
+		l.credits[lane]--
+	}
+}
+
+// buffered takes the notifications buffered in the lanes, from the highest
+// priority lane to the lowest. It must not be called concurrently with next.
+func (l *lanes) buffered() []*Notification {
+	var notifs []*Notification
+	for _, c := range l.chans {
+		for i := len(c); i > 0; i-- {
+			notifs = append(notifs, <-c)
+		}
+	}
+	return notifs
+}
+
+// len returns the number of notifications buffered in the lanes
+func (l *lanes) len() int {
+	n := 0
+	for _, c := range l.chans {
+		n += len(c)
+	}
+	return n
+}
@@ -0,0 +1,60 @@
+package apns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestLanes returns lanes holding count notifications in each lane, with
+// identifiers 100*lane+i
+func newTestLanes(count int, weights []int) *lanes {
+	l := &lanes{weights: weights}
+	for lane := range l.chans {
+		l.chans[lane] = make(chan *Notification, count)
+		for i := 0; i < count; i++ {
+			n := NewNotification()
+			n.SetIdentifier(NotificationIdentifier(100*lane + i))
+			l.chans[lane] <- n
+		}
+	}
+	return l
+}
+
+func nextIdentifiers(l *lanes, count int) []NotificationIdentifier {
+	var ids []NotificationIdentifier
+	for i := 0; i < count; i++ {
+		ids = append(ids, l.next(nil, nil).Identifier())
+	}
+	return ids
+}
+
+func TestStrictLanes(t *testing.T) {
+
+	l := newTestLanes(2, nil)
+
+	assert.Equal(t, []NotificationIdentifier{0, 1, 100, 101, 200, 201}, nextIdentifiers(l, 6))
+	assert.Equal(t, 0, l.len())
+}
+
+func TestWeightedLanes(t *testing.T) {
+
+	l := newTestLanes(4, []int{2, 1, 1})
+
+	assert.Equal(t, []NotificationIdentifier{
+		0, 1, 100, 200,
+		2, 3, 101, 201,
+		// only the lower priority lanes are left
+		102, 202, 103, 203,
+	}, nextIdentifiers(l, 12))
+}
+
+func TestLanesStop(t *testing.T) {
+
+	l := newTestLanes(0, nil)
+
+	stopc := make(chan struct{})
+	close(stopc)
+
+	assert.Nil(t, l.next(stopc, nil))
+}
@@ -1,22 +1,71 @@
 package apns
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"time"
+
+	"github.com/mentionapp/apns.go/codec"
 )
 
 // MaxPayloadLen is the maximum allowed payload length (after JSON encoding)
 const MaxPayloadLen = 256
 
+// ErrNoIdentifier is returned by Notification.Encode when the identifier was
+// not set
+var ErrNoIdentifier = errors.New("apns: identifier was not set")
+
+// ErrDuplicateIdentifier is reported by Sender when a notification has the
+// same identifier as a notification that was recently sent and may still be
+// rejected by APNs
+var ErrDuplicateIdentifier = errors.New("apns: duplicate notification identifier")
+
+// ErrExpired is reported by Sender when a notification expired before it could
+// be written
+var ErrExpired = errors.New("apns: notification expired before it was sent")
+
+// PayloadTooLargeError is returned by Notification.Encode when the encoded
+// payload is larger than MaxPayloadLen
+type PayloadTooLargeError struct {
+	Size int
+	Max  int
+}
+
+func (e *PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("apns: payload is %v bytes, larger than the %v byte limit", e.Size, e.Max)
+}
+
+// InvalidTokenError is returned by Notification.Encode when the device token
+// can not be decoded
+type InvalidTokenError struct {
+	Token string
+	Err   error
+}
+
+func (e *InvalidTokenError) Error() string {
+	return fmt.Sprintf("apns: invalid device token %q: %v", e.Token, e.Err)
+}
+
+func (e *InvalidTokenError) Unwrap() error {
+	return e.Err
+}
+
 // Interface for universal notification payload
 type Topic interface {
 	Bytes() ([]byte, error)
 }
 
+// RawPayload is a payload that is already encoded to JSON
+type RawPayload []byte
+
+// Bytes returns p
+func (p RawPayload) Bytes() ([]byte, error) {
+	return p, nil
+}
+
 // Payload represents a notification payload
 type Payload map[string]interface{}
 
@@ -33,6 +82,9 @@ type Notification struct {
 	identifier  *NotificationIdentifier
 	expiry      time.Time
 	priority    NotificationPriority
+	attempts    int
+	errors      int
+	sentAt      time.Time
 }
 
 // AlertDictionary is a localized alert text
@@ -52,21 +104,6 @@ const (
 	PowerSavingPriority NotificationPriority = 5
 )
 
-const pushCommandValue uint8 = 2
-
-// Constants related to the payload fields and their lengths.
-const (
-	deviceTokenItemid            uint8  = 1
-	payloadItemid                uint8  = 2
-	notificationIdentifierItemid uint8  = 3
-	expirationDateItemid         uint8  = 4
-	priorityItemid               uint8  = 5
-	deviceTokenLength            uint16 = 32
-	notificationIdentifierLength uint16 = 4
-	expirationDateLength         uint16 = 4
-	priorityLength               uint16 = 1
-)
-
 // SetAlertString sets the alert item as a string
 func (p Payload) SetAlertString(alert string) {
 	p.aps()["alert"] = alert
@@ -124,7 +161,9 @@ func NewNotification() *Notification {
 	return n
 }
 
-// SetDeviceToken sets the device token. Must be a 64 bytes hex string.
+// SetDeviceToken sets the device token, as a hex string (64 characters for
+// the usual 32 bytes tokens). Use ParseDeviceToken to validate and normalize
+// tokens from other sources.
 func (n *Notification) SetDeviceToken(token string) {
 	n.deviceToken = token
 }
@@ -145,8 +184,9 @@ func (n *Notification) Payload() Topic {
 }
 
 // SetIdentifier sets a custom identifier. Two notifications sent to the
-// same Sender must have different identifiers. Sender automatically chooses an
-// identifier if one was not set.
+// same Sender must have different identifiers, otherwise the Sender reports
+// ErrDuplicateIdentifier. Sender automatically chooses an identifier if one was
+// not set.
 func (n *Notification) SetIdentifier(identifier NotificationIdentifier) {
 	n.identifier = &identifier
 }
@@ -165,18 +205,39 @@ func (n *Notification) HasIdentifier() bool {
 }
 
 // SetExpiry sets the expiry. Fractions of seconds are truncated. APNS discards
-// the notification if it wasn't able to send it after this duration. An expiry
-// of 0 means that the notification is discarded immediately by APNS if it can
-// not be sent (the is the default).
+// the notification if it wasn't able to send it after this date. An expiry of
+// time.Unix(0, 0) means that the notification is discarded immediately by APNS
+// if it can not be sent. Without an expiry (the zero time, which is the
+// default), the frame carries the zero time truncated to 32 bits, i.e. a date
+// in 2042.
 func (n *Notification) SetExpiry(expiry time.Time) {
 	n.expiry = expiry
 }
 
+// SetTTL sets the expiry to ttl from now
+func (n *Notification) SetTTL(ttl time.Duration) {
+	n.expiry = time.Now().Add(ttl)
+}
+
 // Expiry returns the expiry
 func (n *Notification) Expiry() time.Time {
 	return n.expiry
 }
 
+// SentAt returns when a Sender last wrote the notification, or the zero time
+// if it was never written
+func (n *Notification) SentAt() time.Time {
+	return n.sentAt
+}
+
+// Expired returns whether the expiry is set and is before now. An expired
+// notification is discarded by Sender instead of being written. An expiry of
+// time.Unix(0, 0), which asks APNS not to store the notification, never
+// expires.
+func (n *Notification) Expired(now time.Time) bool {
+	return !n.expiry.IsZero() && n.expiry.Unix() != 0 && n.expiry.Before(now)
+}
+
 // SetPriority sets the priority. The default is ImmediatePriority.
 func (n *Notification) SetPriority(priority NotificationPriority) {
 	n.priority = priority
@@ -196,7 +257,10 @@ func NewAlertDictionary() *AlertDictionary {
 func (n *Notification) Encode() ([]byte, error) {
 	token, err := hex.DecodeString(n.deviceToken)
 	if err != nil {
-		return nil, fmt.Errorf("failed decoding device token %q: %v", n.deviceToken, err)
+		return nil, &InvalidTokenError{Token: n.deviceToken, Err: err}
+	}
+	if len(token) > math.MaxUint16 {
+		return nil, &InvalidTokenError{Token: n.deviceToken, Err: codec.ErrTooLong}
 	}
 
 	payload, err := n.payload.Bytes()
@@ -205,40 +269,45 @@ func (n *Notification) Encode() ([]byte, error) {
 	}
 
 	if len(payload) > MaxPayloadLen {
-		return nil, fmt.Errorf("payload is larger than the %v byte limit", MaxPayloadLen)
+		return nil, &PayloadTooLargeError{Size: len(payload), Max: MaxPayloadLen}
 	}
 
-	BE := binary.BigEndian
+	if n.identifier == nil {
+		return nil, ErrNoIdentifier
+	}
 
-	frameBuffer := &bytes.Buffer{}
+	frame := &codec.Notification{
+		Command:    codec.NotificationCommand,
+		Token:      token,
+		Payload:    payload,
+		Identifier: uint32(*n.identifier),
+		Expiry:     uint32(n.expiry.Unix()),
+		Priority:   uint8(n.priority),
+	}
 
-	binary.Write(frameBuffer, BE, deviceTokenItemid)
-	binary.Write(frameBuffer, BE, deviceTokenLength)
-	binary.Write(frameBuffer, BE, token)
+	return frame.Encode()
+}
 
-	binary.Write(frameBuffer, BE, payloadItemid)
-	binary.Write(frameBuffer, BE, uint16(len(payload)))
-	binary.Write(frameBuffer, BE, payload)
+// noExpiry is the expiry encoded for the zero time
+var noExpiry = uint32(time.Time{}.Unix())
 
-	if n.identifier == nil {
-		return nil, fmt.Errorf("identifier was not set")
+// decodeNotification decodes a notification packet encoded by Encode. The
+// payload of the notification is a RawPayload.
+func decodeNotification(b []byte) (*Notification, error) {
+	frame, err := codec.DecodeNotification(b)
+	if err != nil {
+		return nil, err
 	}
-	binary.Write(frameBuffer, BE, notificationIdentifierItemid)
-	binary.Write(frameBuffer, BE, notificationIdentifierLength)
-	binary.Write(frameBuffer, BE, *n.identifier)
 
-	binary.Write(frameBuffer, BE, expirationDateItemid)
-	binary.Write(frameBuffer, BE, expirationDateLength)
-	binary.Write(frameBuffer, BE, uint32(n.expiry.Unix()))
-
-	binary.Write(frameBuffer, BE, priorityItemid)
-	binary.Write(frameBuffer, BE, priorityLength)
-	binary.Write(frameBuffer, BE, n.priority)
-
-	buffer := bytes.NewBuffer([]byte{})
-	binary.Write(buffer, BE, pushCommandValue)
-	binary.Write(buffer, BE, uint32(frameBuffer.Len()))
-	binary.Write(buffer, BE, frameBuffer.Bytes())
+	n := &Notification{
+		deviceToken: hex.EncodeToString(frame.Token),
+		payload:     RawPayload(frame.Payload),
+		priority:    NotificationPriority(frame.Priority),
+	}
+	n.SetIdentifier(NotificationIdentifier(frame.Identifier))
+	if frame.Expiry != noExpiry {
+		n.expiry = time.Unix(int64(frame.Expiry), 0)
+	}
 
-	return buffer.Bytes(), nil
+	return n, nil
 }
@@ -0,0 +1,67 @@
+package apns
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeExpiry(t *testing.T) {
+
+	encodedExpiry := func(expiry time.Time) uint32 {
+		n := NewNotification()
+		n.SetIdentifier(1)
+		n.SetDeviceToken("740f4707bebcf74f9b7c25d48e3358945f6aa01da5ddb387462c7eaf61bb78ad")
+		n.SetExpiry(expiry)
+
+		b, err := n.Encode()
+		require.NoError(t, err)
+
+		// the expiry item is followed by the 4 bytes of the priority item
+		return binary.BigEndian.Uint32(b[len(b)-8:])
+	}
+
+	assert.Equal(t, uint32(1400000000), encodedExpiry(time.Unix(1400000000, 0)))
+	assert.Equal(t, uint32(0), encodedExpiry(time.Unix(0, 0)))
+
+	// the zero time is truncated to a date in 2042
+	assert.Equal(t, uint32(2288912640), encodedExpiry(time.Time{}))
+	assert.Equal(t, 2042, time.Unix(2288912640, 0).UTC().Year())
+}
+
+func TestDecodeNotificationExpiry(t *testing.T) {
+
+	for _, expiry := range []time.Time{{}, time.Unix(0, 0), time.Unix(1400000000, 0)} {
+		n := NewNotification()
+		n.SetIdentifier(1)
+		n.SetDeviceToken("740f4707bebcf74f9b7c25d48e3358945f6aa01da5ddb387462c7eaf61bb78ad")
+		n.SetExpiry(expiry)
+
+		b, err := n.Encode()
+		require.NoError(t, err)
+
+		decoded, err := decodeNotification(b)
+		require.NoError(t, err)
+		assert.True(t, expiry.Equal(decoded.Expiry()), "%v decoded as %v", expiry, decoded.Expiry())
+	}
+}
+
+func TestNotificationExpired(t *testing.T) {
+
+	now := time.Unix(1400000000, 0)
+	n := NewNotification()
+
+	assert.False(t, n.Expired(now))
+
+	n.SetExpiry(now.Add(-time.Second))
+	assert.True(t, n.Expired(now))
+
+	n.SetExpiry(now.Add(time.Second))
+	assert.False(t, n.Expired(now))
+
+	n.SetExpiry(time.Unix(0, 0))
+	assert.False(t, n.Expired(now))
+}
@@ -0,0 +1,193 @@
+package apns
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestProxy starts a local proxy stand-in calling serve with each
+// accepted connection
+func startTestProxy(t *testing.T, serve func(c net.Conn)) (addr string, closeFn func()) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				serve(c)
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func pipe(client net.Conn, addr string) {
+	upstream, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	go io.Copy(upstream, client)
+	io.Copy(client, upstream)
+}
+
+// serveHTTPConnect is a minimal HTTP CONNECT proxy requiring basic auth
+func serveHTTPConnect(c net.Conn) {
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+
+	user, password, ok := (&http.Request{Header: http.Header{
+		"Authorization": req.Header["Proxy-Authorization"],
+	}}).BasicAuth()
+	if !ok || user != "user" || password != "secret" {
+		io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+
+	if req.Method != "CONNECT" {
+		io.WriteString(c, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return
+	}
+
+	io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+	pipe(c, req.Host)
+}
+
+// serveSOCKS5 is a minimal SOCKS5 proxy requiring username/password auth
+func serveSOCKS5(c net.Conn) {
+	buf := make([]byte, 256)
+
+	// greeting
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+		return
+	}
+	c.Write([]byte{5, 2})
+
+	// username/password
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	user := make([]byte, buf[1])
+	io.ReadFull(c, user)
+	io.ReadFull(c, buf[:1])
+	password := make([]byte, buf[0])
+	io.ReadFull(c, password)
+	if string(user) != "user" || string(password) != "secret" {
+		c.Write([]byte{1, 1})
+		return
+	}
+	c.Write([]byte{1, 0})
+
+	// connect request
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(c, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		io.ReadFull(c, buf[:1])
+		name := make([]byte, buf[0])
+		io.ReadFull(c, name)
+		host = string(name)
+	default:
+		return
+	}
+	io.ReadFull(c, buf[:2])
+	port := binary.BigEndian.Uint16(buf[:2])
+
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	pipe(c, net.JoinHostPort(host, strconv.Itoa(int(port))))
+}
+
+func testFetchFeedbackThroughProxy(t *testing.T, serve func(c net.Conn), scheme string) {
+
+	g := newTestFeedbackGateway(t)
+	defer g.Close()
+
+	proxyAddr, closeProxy := startTestProxy(t, serve)
+	defer closeProxy()
+
+	cert := newTestCertificate(t, time.Now().Add(time.Hour))
+
+	for _, tc := range []struct {
+		user  *url.Userinfo
+		valid bool
+	}{
+		{url.UserPassword("user", "secret"), true},
+		{url.UserPassword("user", "wrong"), false},
+	} {
+		d, err := NewProxyDialer(&url.URL{Scheme: scheme, Host: proxyAddr, User: tc.user}, nil)
+		require.NoError(t, err)
+
+		msgs, err := FetchFeedback(context.Background(), g.addr, cert,
+			FeedbackTLSConfig(&tls.Config{RootCAs: g.roots}),
+			FeedbackDialer(d),
+			FeedbackTimeouts(time.Second*5, time.Second*5))
+
+		if tc.valid {
+			assert.NoError(t, err)
+			assert.Len(t, msgs, 1)
+		} else {
+			assert.Error(t, err)
+		}
+	}
+}
+
+func TestHTTPProxyDialer(t *testing.T) {
+	testFetchFeedbackThroughProxy(t, serveHTTPConnect, "http")
+}
+
+func TestSOCKS5ProxyDialer(t *testing.T) {
+	testFetchFeedbackThroughProxy(t, serveSOCKS5, "socks5")
+}
+
+func TestNewProxyDialerRejectsUnknownSchemes(t *testing.T) {
+	_, err := NewProxyDialer(&url.URL{Scheme: "ftp", Host: "127.0.0.1:21"}, nil)
+	assert.Error(t, err)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+
+	// a server that accepts connections but never completes the handshake
+	addr, closeServer := startTestProxy(t, func(c net.Conn) {
+		io.Copy(io.Discard, c)
+	})
+	defer closeServer()
+
+	start := time.Now()
+	_, err := FetchFeedback(context.Background(), addr, newTestCertificate(t, time.Now().Add(time.Hour)),
+		FeedbackTimeouts(0, time.Millisecond*100))
+
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second*5)
+}
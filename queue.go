@@ -2,39 +2,79 @@ package apns
 
 import (
 	"container/list"
+	"log"
 	"time"
 )
 
+const defaultQueueRetention = 60 * time.Second
+
+// queueConfig limits the notifications kept by a queue
+type queueConfig struct {
+	retention time.Duration
+	maxLen    int
+	maxBytes  int
+	compact   bool
+}
+
+// queue keeps sent notifications in the order they were sent. Identifiers may
+// repeat (e.g. after wraparound): lookups by identifier return the most
+// recently added notification.
 type queue struct {
-	l        *list.List
-	m        map[NotificationIdentifier]*list.Element
-	duration time.Duration
+	l     *list.List
+	m     map[NotificationIdentifier]*list.Element
+	conf  queueConfig
+	bytes int
 }
 
+// queueElem holds either n, or its encoded frame in compact mode
 type queueElem struct {
-	n       *Notification
-	addedAt time.Time
+	n        *Notification
+	frame    []byte
+	id       NotificationIdentifier
+	attempts int
+	errors   int
+	size     int
+	addedAt  time.Time
 }
 
 // newQueue creates a new queue
-func newQueue(duration time.Duration) *queue {
+func newQueue(conf queueConfig) *queue {
 	return &queue{
-		l:        list.New(),
-		m:        make(map[NotificationIdentifier]*list.Element),
-		duration: duration,
+		l:    list.New(),
+		m:    make(map[NotificationIdentifier]*list.Element),
+		conf: conf,
 	}
 }
 
-func (q *queue) Add(n *Notification) {
+// Add adds n to the queue. frame is the encoded notification; it is kept
+// instead of n in compact mode.
+func (q *queue) Add(n *Notification, frame []byte) {
+
+	elem := &queueElem{
+		id:       n.Identifier(),
+		attempts: n.attempts,
+		errors:   n.errors,
+		size:     len(frame),
+		addedAt:  time.Now(),
+	}
+	if q.conf.compact && frame != nil {
+		elem.frame = frame
+	} else {
+		elem.n = n
+	}
+
+	e := q.l.PushBack(elem)
+	q.bytes += elem.size
+
+	q.m[elem.id] = e
 
-	e := q.l.PushBack(&queueElem{n, time.Now()})
-	q.m[n.Identifier()] = e
+	q.Expire()
 }
 
 func (q *queue) Get(identifier NotificationIdentifier) *Notification {
 
 	if e, ok := q.m[identifier]; ok {
-		return e.Value.(*queueElem).n
+		return e.Value.(*queueElem).notification()
 	}
 
 	return nil
@@ -42,34 +82,38 @@ func (q *queue) Get(identifier NotificationIdentifier) *Notification {
 
 func (q *queue) GetAllAfter(identifier NotificationIdentifier) []*Notification {
 
-	var s []*Notification
-	var e *list.Element
-	var ok bool
-
-	if e, ok = q.m[identifier]; ok {
-		e = e.Next()
-	} else {
-		e = q.l.Front()
-	}
-
-	for ; e != nil; e = e.Next() {
-		s = append(s, e.Value.(*queueElem).n)
+	if e, ok := q.m[identifier]; ok {
+		return q.getFrom(e.Next())
 	}
 
-	return s
+	return q.getFrom(q.l.Front())
 }
 
 func (q *queue) GetAll() []*Notification {
+	return q.getFrom(q.l.Front())
+}
+
+func (q *queue) getFrom(e *list.Element) []*Notification {
 
 	var s []*Notification
 
-	for e := q.l.Front(); e != nil; e = e.Next() {
-		s = append(s, e.Value.(*queueElem).n)
+	for ; e != nil; e = e.Next() {
+		if n := e.Value.(*queueElem).notification(); n != nil {
+			s = append(s, n)
+		}
 	}
 
 	return s
 }
 
+// Len returns the number of notifications in the queue, and the size of their
+// encoded frames
+func (q *queue) Len() (int, int) {
+	return q.l.Len(), q.bytes
+}
+
+// Expire removes the notifications older than the retention, and the oldest
+// ones while the queue is over its limits
 func (q *queue) Expire() {
 
 	now := time.Now()
@@ -79,11 +123,41 @@ func (q *queue) Expire() {
 			break
 		}
 		elem := front.Value.(*queueElem)
-		if now.Sub(elem.addedAt) > q.duration {
-			q.l.Remove(front)
-			delete(q.m, elem.n.Identifier())
+		if now.Sub(elem.addedAt) > q.conf.retention ||
+			(q.conf.maxLen > 0 && q.l.Len() > q.conf.maxLen) ||
+			(q.conf.maxBytes > 0 && q.bytes > q.conf.maxBytes) {
+			q.remove(front)
 		} else {
 			break
 		}
 	}
 }
+
+func (q *queue) remove(e *list.Element) {
+	elem := q.l.Remove(e).(*queueElem)
+	q.bytes -= elem.size
+
+	// a more recent notification may have the same identifier
+	if q.m[elem.id] == e {
+		delete(q.m, elem.id)
+	}
+}
+
+// notification returns the notification of the element, decoding it in compact
+// mode
+func (elem *queueElem) notification() *Notification {
+	if elem.n != nil {
+		return elem.n
+	}
+
+	n, err := decodeNotification(elem.frame)
+	if err != nil {
+		log.Printf("Failed decoding sent notification %v: %v", elem.id, err)
+		return nil
+	}
+	n.attempts = elem.attempts
+	n.errors = elem.errors
+	n.sentAt = elem.addedAt
+
+	return n
+}
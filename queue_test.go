@@ -0,0 +1,125 @@
+package apns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueDuplicateIdentifiers(t *testing.T) {
+
+	notif := func(id int) *Notification {
+		n := &Notification{}
+		n.SetIdentifier(NotificationIdentifier(id))
+		return n
+	}
+
+	q := newQueue(queueConfig{retention: time.Minute})
+
+	n1, n2, n3, n1bis := notif(1), notif(2), notif(3), notif(1)
+
+	q.Add(n1, nil)
+	q.Add(n2, nil)
+	q.Add(n3, nil)
+	q.Add(n1bis, nil)
+
+	// the most recent notification wins
+	assert.True(t, q.Get(1) == n1bis)
+	assert.Empty(t, q.GetAllAfter(1))
+
+	// expiring the older notification keeps the recent one
+	q.remove(q.l.Front())
+	assert.True(t, q.Get(1) == n1bis)
+}
+
+func TestQueueExpire(t *testing.T) {
+
+	q := newQueue(queueConfig{retention: time.Millisecond})
+
+	n := &Notification{}
+	n.SetIdentifier(1)
+	q.Add(n, nil)
+
+	time.Sleep(time.Millisecond * 5)
+	q.Expire()
+
+	assert.Nil(t, q.Get(1))
+	assert.Empty(t, q.GetAll())
+}
+
+func TestQueueLimits(t *testing.T) {
+
+	add := func(q *queue, id int) {
+		n := NewNotification()
+		n.SetDeviceToken("0000000000000000000000000000000000000000000000000000000000000001")
+		n.SetIdentifier(NotificationIdentifier(id))
+		frame, err := n.Encode()
+		require.NoError(t, err)
+		q.Add(n, frame)
+	}
+
+	ids := func(q *queue) []NotificationIdentifier {
+		var s []NotificationIdentifier
+		for _, n := range q.GetAll() {
+			s = append(s, n.Identifier())
+		}
+		return s
+	}
+
+	q := newQueue(queueConfig{retention: time.Minute, maxLen: 2})
+	for i := 0; i < 4; i++ {
+		add(q, i)
+	}
+	assert.Equal(t, []NotificationIdentifier{2, 3}, ids(q))
+	assert.Nil(t, q.Get(1))
+
+	// each frame is 63 bytes
+	q = newQueue(queueConfig{retention: time.Minute, maxBytes: 150})
+	for i := 0; i < 4; i++ {
+		add(q, i)
+	}
+	assert.Equal(t, []NotificationIdentifier{2, 3}, ids(q))
+
+	count, bytes := q.Len()
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 126, bytes)
+}
+
+func TestQueueCompact(t *testing.T) {
+
+	q := newQueue(queueConfig{retention: time.Minute, compact: true})
+
+	n := NewNotification()
+	n.SetDeviceToken("00000000000000000000000000000000000000000000000000000000000000ff")
+	n.SetIdentifier(7)
+	n.SetExpiry(time.Unix(1400000000, 0))
+	n.SetPriority(PowerSavingPriority)
+	p := Payload{}
+	p.SetAlertString("hello")
+	n.SetPayload(p)
+	n.attempts = 2
+
+	frame, err := n.Encode()
+	require.NoError(t, err)
+	q.Add(n, frame)
+
+	decoded := q.Get(7)
+	require.NotNil(t, decoded)
+	assert.False(t, decoded == n)
+
+	assert.Equal(t, n.DeviceToken(), decoded.DeviceToken())
+	assert.Equal(t, n.Identifier(), decoded.Identifier())
+	assert.True(t, n.Expiry().Equal(decoded.Expiry()))
+	assert.Equal(t, n.Priority(), decoded.Priority())
+	assert.Equal(t, 2, decoded.attempts)
+
+	payload, err := decoded.Payload().Bytes()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"aps":{"alert":"hello"}}`, string(payload))
+
+	reencoded, err := decoded.Encode()
+	require.NoError(t, err)
+	assert.Equal(t, frame, reencoded)
+}
@@ -0,0 +1,170 @@
+package apns
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// TokenRegistry keeps track of device tokens and of whether they are still
+// active.
+//
+// APNs reports tokens that should not be used anymore through the feedback
+// service and through InvalidTokenErrorStatus error-responses. A device may
+// register its token again after that, in which case the token must be kept.
+// Implementations must be safe for concurrent use.
+type TokenRegistry interface {
+	// Register records that token was registered by a device at time at. The
+	// token becomes active.
+	Register(token string, at time.Time) error
+	// Unregister deactivates token, unless it was registered after at. It
+	// returns whether the token has been deactivated.
+	Unregister(token string, at time.Time) (bool, error)
+	// Active returns whether token is registered and active.
+	Active(token string) (bool, error)
+}
+
+// UnregisterFeedback deactivates the token of msg, unless the device registered
+// it again after msg.Unsubscribe.
+func UnregisterFeedback(r TokenRegistry, msg *FeedbackMessage) (bool, error) {
+	return r.Unregister(msg.DeviceToken, msg.Unsubscribe)
+}
+
+// UnregisterSenderError deactivates the token of e.Notification if e reports an
+// invalid token, unless the device registered it again after the notification
+// was sent. Other errors are ignored.
+func UnregisterSenderError(r TokenRegistry, e *SenderError) (bool, error) {
+	if !errors.Is(e, ErrInvalidToken) {
+		return false, nil
+	}
+
+	// tokens rejected before being written are unregistered as of now
+	at := e.Notification.SentAt()
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	return r.Unregister(e.Notification.DeviceToken(), at)
+}
+
+// ConsumeFeedback unregisters the tokens received on msgs (usually
+// Feedback.Messages()) until the channel is closed. Registry errors are logged
+// and the first one is returned once msgs is closed.
+func ConsumeFeedback(r TokenRegistry, msgs <-chan *FeedbackMessage) error {
+	var firstErr error
+	for msg := range msgs {
+		ok, err := UnregisterFeedback(r, msg)
+		if err != nil {
+			log.Printf("Failed unregistering token %v: %v", msg.DeviceToken, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if ok {
+			info("Unregistered token %v", msg.DeviceToken)
+		}
+	}
+	return firstErr
+}
+
+// ConsumeSenderErrors unregisters the invalid tokens reported on errs (usually
+// Sender.Errors()) until the channel is closed or, if done is not nil, until
+// done is closed (usually Sender.Done()) and the errors already buffered are
+// consumed. Registry errors are logged and the first one is returned.
+func ConsumeSenderErrors(r TokenRegistry, errs <-chan *SenderError, done <-chan struct{}) error {
+	var firstErr error
+
+	unregister := func(e *SenderError) {
+		ok, err := UnregisterSenderError(r, e)
+		if err != nil {
+			log.Printf("Failed unregistering token %v: %v", e.Notification.DeviceToken(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if ok {
+			info("Unregistered token %v", e.Notification.DeviceToken())
+		}
+	}
+
+	for {
+		select {
+		case e, ok := <-errs:
+			if !ok {
+				return firstErr
+			}
+			unregister(e)
+		case <-done:
+			for {
+				select {
+				case e, ok := <-errs:
+					if !ok {
+						return firstErr
+					}
+					unregister(e)
+				default:
+					return firstErr
+				}
+			}
+		}
+	}
+}
+
+func normalizeRegistryToken(token string) string {
+	return normalizeDeviceToken(token)
+}
+
+type memoryToken struct {
+	registeredAt time.Time
+	active       bool
+}
+
+// MemoryTokenRegistry is a TokenRegistry that keeps tokens in memory
+type MemoryTokenRegistry struct {
+	mu     sync.Mutex
+	tokens map[string]*memoryToken
+}
+
+// NewMemoryTokenRegistry creates a new MemoryTokenRegistry
+func NewMemoryTokenRegistry() *MemoryTokenRegistry {
+	return &MemoryTokenRegistry{
+		tokens: make(map[string]*memoryToken),
+	}
+}
+
+func (r *MemoryTokenRegistry) Register(token string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	token = normalizeRegistryToken(token)
+	if t, ok := r.tokens[token]; ok {
+		if at.After(t.registeredAt) {
+			t.registeredAt = at
+		}
+		t.active = true
+	} else {
+		r.tokens[token] = &memoryToken{registeredAt: at, active: true}
+	}
+
+	return nil
+}
+
+func (r *MemoryTokenRegistry) Unregister(token string, at time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.tokens[normalizeRegistryToken(token)]
+	if !ok || !t.active || t.registeredAt.After(at) {
+		return false, nil
+	}
+	t.active = false
+
+	return true, nil
+}
+
+func (r *MemoryTokenRegistry) Active(token string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.tokens[normalizeRegistryToken(token)]
+	return ok && t.active, nil
+}
@@ -0,0 +1,61 @@
+package apns
+
+import (
+	"database/sql"
+	"time"
+)
+
+const sqliteTokenRegistrySchema = `CREATE TABLE IF NOT EXISTS apns_tokens (
+	token         TEXT PRIMARY KEY,
+	registered_at INTEGER NOT NULL,
+	active        INTEGER NOT NULL
+)`
+
+// SQLiteTokenRegistry is a TokenRegistry that stores tokens in the apns_tokens
+// table of a SQLite database. The caller chooses and imports the driver.
+type SQLiteTokenRegistry struct {
+	db *sql.DB
+}
+
+// NewSQLiteTokenRegistry creates a new SQLiteTokenRegistry. The apns_tokens
+// table is created if it doesn't exist.
+func NewSQLiteTokenRegistry(db *sql.DB) (*SQLiteTokenRegistry, error) {
+	if _, err := db.Exec(sqliteTokenRegistrySchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteTokenRegistry{db: db}, nil
+}
+
+func (r *SQLiteTokenRegistry) Register(token string, at time.Time) error {
+	_, err := r.db.Exec(`INSERT INTO apns_tokens (token, registered_at, active)
+		VALUES (?, ?, 1)
+		ON CONFLICT (token) DO UPDATE SET
+			registered_at = max(registered_at, excluded.registered_at),
+			active = 1`,
+		normalizeRegistryToken(token), at.UnixNano())
+	return err
+}
+
+func (r *SQLiteTokenRegistry) Unregister(token string, at time.Time) (bool, error) {
+	res, err := r.db.Exec(`UPDATE apns_tokens SET active = 0
+		WHERE token = ? AND active = 1 AND registered_at <= ?`,
+		normalizeRegistryToken(token), at.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (r *SQLiteTokenRegistry) Active(token string) (bool, error) {
+	var active bool
+	err := r.db.QueryRow(`SELECT active FROM apns_tokens WHERE token = ?`,
+		normalizeRegistryToken(token)).Scan(&active)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return active, err
+}
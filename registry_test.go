@@ -0,0 +1,160 @@
+package apns
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTokenRegistry(t *testing.T, r TokenRegistry) {
+
+	t0 := time.Unix(1400000000, 0)
+	token := "abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789"
+
+	active, err := r.Active(token)
+	require.NoError(t, err)
+	assert.False(t, active)
+
+	ok, err := r.Unregister(token, t0)
+	require.NoError(t, err)
+	assert.False(t, ok, "unknown tokens can not be unregistered")
+
+	require.NoError(t, r.Register(token, t0))
+
+	active, err = r.Active(token)
+	require.NoError(t, err)
+	assert.True(t, active)
+
+	ok, err = r.Unregister(token, t0.Add(-time.Second))
+	require.NoError(t, err)
+	assert.False(t, ok, "tokens registered after unsubscription must be kept")
+
+	ok, err = r.Unregister("ABCDEF0123456789abcdef0123456789abcdef0123456789abcdef0123456789", t0.Add(time.Second))
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	active, err = r.Active(token)
+	require.NoError(t, err)
+	assert.False(t, active)
+
+	ok, err = r.Unregister(token, t0.Add(time.Second))
+	require.NoError(t, err)
+	assert.False(t, ok, "inactive tokens are not unregistered twice")
+
+	require.NoError(t, r.Register(token, t0.Add(time.Second*2)))
+
+	active, err = r.Active(token)
+	require.NoError(t, err)
+	assert.True(t, active)
+}
+
+func TestMemoryTokenRegistry(t *testing.T) {
+	testTokenRegistry(t, NewMemoryTokenRegistry())
+}
+
+func TestSQLiteTokenRegistry(t *testing.T) {
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	db.SetMaxOpenConns(1)
+
+	r, err := NewSQLiteTokenRegistry(db)
+	require.NoError(t, err)
+
+	testTokenRegistry(t, r)
+}
+
+func TestConsumeFeedback(t *testing.T) {
+
+	t0 := time.Unix(1400000000, 0)
+	kept := "0000000000000000000000000000000000000000000000000000000000000001"
+	removed := "0000000000000000000000000000000000000000000000000000000000000002"
+
+	r := NewMemoryTokenRegistry()
+	r.Register(kept, t0.Add(time.Minute))
+	r.Register(removed, t0)
+
+	msgs := make(chan *FeedbackMessage, 2)
+	msgs <- &FeedbackMessage{Unsubscribe: t0.Add(time.Second), DeviceToken: kept}
+	msgs <- &FeedbackMessage{Unsubscribe: t0.Add(time.Second), DeviceToken: removed}
+	close(msgs)
+
+	assert.NoError(t, ConsumeFeedback(r, msgs))
+
+	active, _ := r.Active(kept)
+	assert.True(t, active)
+
+	active, _ = r.Active(removed)
+	assert.False(t, active)
+}
+
+func TestUnregisterSenderError(t *testing.T) {
+
+	token := "0000000000000000000000000000000000000000000000000000000000000001"
+
+	r := NewMemoryTokenRegistry()
+	r.Register(token, time.Now().Add(-time.Minute))
+
+	n := NewNotification()
+	n.SetDeviceToken(token)
+
+	ok, err := UnregisterSenderError(r, &SenderError{
+		Notification:  n,
+		ErrorResponse: &ErrorResponse{Status: ProcessingErrorStatus},
+	})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = UnregisterSenderError(r, &SenderError{
+		Notification:  n,
+		ErrorResponse: &ErrorResponse{Status: InvalidTokenErrorStatus},
+	})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestConsumeSenderErrors(t *testing.T) {
+
+	t0 := time.Unix(1400000000, 0)
+	kept := "0000000000000000000000000000000000000000000000000000000000000001"
+	removed := "0000000000000000000000000000000000000000000000000000000000000002"
+
+	r := NewMemoryTokenRegistry()
+	r.Register(kept, t0)
+	r.Register(removed, t0)
+
+	// the device registered kept again after the notification was sent, and
+	// before the error-response arrived
+	r.Register(kept, t0.Add(time.Minute))
+
+	sentError := func(token string) *SenderError {
+		n := NewNotification()
+		n.SetDeviceToken(token)
+		n.sentAt = t0.Add(time.Second)
+		return &SenderError{
+			Notification:  n,
+			ErrorResponse: &ErrorResponse{Status: InvalidTokenErrorStatus},
+		}
+	}
+
+	errs := make(chan *SenderError, 2)
+	errs <- sentError(kept)
+	errs <- sentError(removed)
+
+	done := make(chan struct{})
+	close(done)
+
+	assert.NoError(t, ConsumeSenderErrors(r, errs, done))
+
+	active, _ := r.Active(kept)
+	assert.True(t, active)
+
+	active, _ = r.Active(removed)
+	assert.False(t, active)
+}
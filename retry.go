@@ -0,0 +1,78 @@
+package apns
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+// RetryPolicy controls how a Sender retries connecting to APNs and sending
+// notifications
+type RetryPolicy struct {
+	// InitialInterval, MaxInterval and Multiplier control the exponential
+	// backoff between two connection attempts
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// MaxElapsedTime is the time after which the Sender gives up connecting
+	// and fails the notification being sent. Zero means never.
+	MaxElapsedTime time.Duration
+	// MaxAttempts is the number of times a notification may be written,
+	// including after write errors and after being requeued because the
+	// connection was closed. Zero means no limit.
+	MaxAttempts int
+	// MaxRetryableErrors is the number of times a notification is requeued
+	// after APNs rejected it with an error-response of RetryableErrorClass
+	// (e.g. ProcessingErrorStatus), before being reported as a SenderError.
+	// Zero disables requeuing.
+	MaxRetryableErrors int
+}
+
+// DefaultRetryPolicy returns the RetryPolicy used by default: it retries
+// connecting forever, and requeues a notification at most 3 times after
+// retryable error-responses.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		InitialInterval:    backoff.DefaultInitialInterval,
+		MaxInterval:        backoff.DefaultMaxInterval,
+		Multiplier:         backoff.DefaultMultiplier,
+		MaxRetryableErrors: 3,
+	}
+}
+
+func (p *RetryPolicy) newBackOff() backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	if p.InitialInterval > 0 {
+		b.InitialInterval = p.InitialInterval
+	}
+	if p.MaxInterval > 0 {
+		b.MaxInterval = p.MaxInterval
+	}
+	if p.Multiplier > 0 {
+		b.Multiplier = p.Multiplier
+	}
+	b.MaxElapsedTime = p.MaxElapsedTime
+	b.Reset()
+	return b
+}
+
+// RetryError reports that a Sender gave up sending a notification, because
+// of its RetryPolicy
+type RetryError struct {
+	// Attempts is the number of times the notification was written
+	Attempts int
+	// Err is the last error
+	Err error
+}
+
+func (e *RetryError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("gave up after %v attempts", e.Attempts)
+	}
+	return fmt.Sprintf("gave up after %v attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
@@ -2,7 +2,13 @@ package apns
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -16,28 +22,336 @@ const (
 
 var Verbose bool
 
+const (
+	defaultDrainTimeout = 30 * time.Second
+
+	// certificateRetryInterval is the delay before connecting again after the
+	// certificate was rejected, unless it is replaced
+	certificateRetryInterval = time.Minute
+
+	// defaultErrorHandlerQueue is the number of errors queued for the
+	// function of SenderErrorHandler
+	defaultErrorHandlerQueue = 1024
+
+	// shutdownGrace is for how long Shutdown waits for its result after its
+	// context is done
+	shutdownGrace = time.Second
+)
+
+var defaultCertificateExpiryThresholds = []time.Duration{
+	30 * 24 * time.Hour,
+	7 * 24 * time.Hour,
+	24 * time.Hour,
+}
+
 // Sender sends notifications
 type Sender struct {
-	addr       string
-	cert       *tls.Certificate
-	conn       conn
-	notifc     chan *Notification
-	prioNotifc *priochan
-	errorc     chan *SenderError
-	readc      chan *readEvent
-	newConn    func(addr string, cert *tls.Certificate) (conn, error)
-	donec      chan struct{}
-	nextId     NotificationIdentifier
-}
-
-// SenderError represents a sender error
+	addr         string
+	certMu       sync.Mutex
+	cert         *tls.Certificate
+	certGen      uint64
+	conn         conn
+	connGen      uint64
+	draining     map[conn]time.Time
+	drainTimeout time.Duration
+	lanes        lanes
+	bufferSize   int
+	acceptc      chan *Notification
+	pending      int64
+	shutdownc    chan *shutdownRequest
+	shutdownReq  *shutdownRequest
+	shutdownOnce sync.Once
+	abandonc     chan struct{}
+	heldShutdown *shutdownRequest
+	heldPause    *pauseRequest
+	unsent       []*Notification
+	closingc     chan struct{}
+	pausec       chan *pauseRequest
+	paused       bool
+	pauseDrain   bool
+	prioNotifc   *priochan
+	errorc       chan *SenderError
+	readc        chan *readEvent
+	newConn      func(addr string, cert *tls.Certificate) (conn, error)
+	dial         dialConfig
+	retryPolicy  RetryPolicy
+	queue        queueConfig
+	donec        chan struct{}
+	nextId       NotificationIdentifier
+	checkCert    bool
+	checkTokens  bool
+	certErr      *CertificateError
+	certErrGen   uint64
+	certErrAt    time.Time
+	expiry       certificateExpiry
+	events       *dispatcher
+	onEvent      func(ev *SenderEvent)
+	errorBuffer  int
+	dropErrors   bool
+	errorHandler *dispatcher
+	onError      func(e *SenderError)
+	statsMu      sync.Mutex
+	stats        SenderStats
+}
+
+// ErrSenderFull is returned by TrySend when the buffer of the Sender is full
+var ErrSenderFull = errors.New("apns: sender buffer is full")
+
+// ErrSenderClosed is reported for notifications sent to a Sender after
+// Shutdown was called, and returned by Shutdown if it was already called
+var ErrSenderClosed = errors.New("apns: sender is shut down")
+
+// errInterrupted is returned by connect when it stopped retrying because of a
+// request or of a context
+var errInterrupted = errors.New("apns: connecting was interrupted")
+
+// shutdownRequest asks senderJob to shut down. It replies on resultc.
+type shutdownRequest struct {
+	ctx     context.Context
+	resultc chan *shutdownResult
+}
+
+type shutdownResult struct {
+	unknown []*Notification
+	err     error
+}
+
+// pauseRequest asks senderJob to pause or resume. It closes donec once done.
+type pauseRequest struct {
+	paused bool
+	donec  chan struct{}
+}
+
+// certificateExpiry tracks the expiry warnings emitted for a certificate
+type certificateExpiry struct {
+	checked    bool
+	gen        uint64
+	notAfter   time.Time
+	thresholds []time.Duration
+	warned     int
+	expired    bool
+}
+
+// SenderOption configures a Sender
+type SenderOption func(s *Sender)
+
+// SenderCheckCertificate makes StartSender fail if cert is not an APNs
+// certificate valid for the environment of the gateway (e.g. a sandbox
+// certificate used with SenderGateway). NewSender only logs the failure.
+func SenderCheckCertificate() SenderOption {
+	return func(s *Sender) {
+		s.checkCert = true
+	}
+}
+
+// SenderValidateTokens makes the Sender parse device tokens with
+// ParseDeviceToken before sending notifications. Valid tokens are replaced by
+// their normalized form. TrySend returns the *InvalidTokenError of an invalid
+// token; notifications with invalid tokens sent to the channels are reported
+// as a SenderError with an *InvalidTokenError instead of being written.
+func SenderValidateTokens() SenderOption {
+	return func(s *Sender) {
+		s.checkTokens = true
+	}
+}
+
+// SenderDisconnectWhenPaused makes Pause drain the connection: it is closed
+// after SenderDrainTimeout, and Resume opens a new one.
+func SenderDisconnectWhenPaused() SenderOption {
+	return func(s *Sender) {
+		s.pauseDrain = true
+	}
+}
+
+// SenderDrainTimeout sets for how long a connection still receives
+// error-responses after SetCertificate was called, before being closed. The
+// default is 30 seconds.
+func SenderDrainTimeout(d time.Duration) SenderOption {
+	return func(s *Sender) {
+		s.drainTimeout = d
+	}
+}
+
+// SenderTLSConfig sets the TLS configuration used to connect to APNs, e.g. to
+// trust custom root CAs or to require a minimum TLS version. The client
+// certificate is always the current one of the Sender.
+func SenderTLSConfig(conf *tls.Config) SenderOption {
+	return func(s *Sender) {
+		s.dial.tlsConfig = conf
+	}
+}
+
+// SenderDialer sets the Dialer used to connect to APNs, e.g. a proxy Dialer
+// created with NewProxyDialer
+func SenderDialer(d Dialer) SenderOption {
+	return func(s *Sender) {
+		s.dial.dialer = d
+	}
+}
+
+// SenderTimeouts sets the timeouts of the TCP connection and of the TLS
+// handshake with APNs. Zero keeps the default of 30 seconds; a negative value
+// disables the timeout.
+func SenderTimeouts(dial, handshake time.Duration) SenderOption {
+	return func(s *Sender) {
+		s.dial.dialTimeout = dial
+		s.dial.handshakeTimeout = handshake
+	}
+}
+
+// SenderQueueRetention sets for how long sent notifications are kept, to be
+// sent again if APNs reports an error for a notification sent before them. The
+// default is 60 seconds, which is also used for non-positive durations.
+func SenderQueueRetention(d time.Duration) SenderOption {
+	return func(s *Sender) {
+		if d <= 0 {
+			d = defaultQueueRetention
+		}
+		s.queue.retention = d
+	}
+}
+
+// SenderQueueLimits limits the number and the encoded size of the sent
+// notifications kept for each connection; the oldest ones are dropped first.
+// Zero means no limit, which is the default.
+func SenderQueueLimits(count, bytes int) SenderOption {
+	return func(s *Sender) {
+		s.queue.maxLen = count
+		s.queue.maxBytes = bytes
+	}
+}
+
+// SenderCompactQueue keeps sent notifications in their encoded form, which
+// takes less memory. Notifications sent again and those of SenderErrors
+// reported by APNs are then decoded copies, with a RawPayload.
+func SenderCompactQueue() SenderOption {
+	return func(s *Sender) {
+		s.queue.compact = true
+	}
+}
+
+// SenderRetryPolicy sets the RetryPolicy of the Sender. The default is
+// DefaultRetryPolicy().
+func SenderRetryPolicy(p RetryPolicy) SenderOption {
+	return func(s *Sender) {
+		s.retryPolicy = p
+	}
+}
+
+// SenderEventHandler sets a function called with the events of the Sender.
+// It is called from a dedicated goroutine, in the order of the events.
+func SenderEventHandler(f func(ev *SenderEvent)) SenderOption {
+	return func(s *Sender) {
+		s.onEvent = f
+	}
+}
+
+// SenderBuffer sets the capacity of the Notifications() channel. The default
+// is 0 (unbuffered).
+func SenderBuffer(size int) SenderOption {
+	return func(s *Sender) {
+		s.bufferSize = size
+	}
+}
+
+// SenderErrorBuffer sets the capacity of the Errors() channel. The Sender
+// stops sending while the channel is full. The default is 0 (unbuffered).
+func SenderErrorBuffer(size int) SenderOption {
+	return func(s *Sender) {
+		s.errorBuffer = size
+		s.dropErrors = false
+	}
+}
+
+// SenderErrorDropOldest sets the capacity of the Errors() channel, and drops
+// the oldest error when it is full instead of waiting. Dropped errors are
+// counted in SenderStats.DroppedErrors.
+func SenderErrorDropOldest(size int) SenderOption {
+	return func(s *Sender) {
+		if size < 1 {
+			size = 1
+		}
+		s.errorBuffer = size
+		s.dropErrors = true
+	}
+}
+
+// SenderErrorHandler sets a function called with the errors of the Sender,
+// instead of sending them to Errors(). It is called from a dedicated
+// goroutine, in the order of the errors; errors are queued while it runs. If f
+// can not keep up, the oldest queued errors are dropped and counted in
+// SenderStats.DroppedErrors: up to 1024 errors are queued, or the size set
+// with SenderErrorDropOldest.
+func SenderErrorHandler(f func(e *SenderError)) SenderOption {
+	return func(s *Sender) {
+		s.onError = f
+	}
+}
+
+// SenderCertificateExpiryThresholds sets the durations before the expiry of
+// the certificate at which a warning is logged and a CertificateExpiringEvent
+// is emitted. The default is 30, 7 and 1 days.
+func SenderCertificateExpiryThresholds(thresholds ...time.Duration) SenderOption {
+	return func(s *Sender) {
+		s.expiry.thresholds = append([]time.Duration{}, thresholds...)
+		sort.Sort(sort.Reverse(durations(s.expiry.thresholds)))
+	}
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// SenderError represents a sender error. ErrorResponse is nil if the
+// notification could not be sent, in which case Err tells why.
 type SenderError struct {
 	Notification  *Notification
 	ErrorResponse *ErrorResponse
+	Err           error
+}
+
+func (e *SenderError) Error() string {
+	return fmt.Sprintf("failed sending notification %v to %v: %v", e.Notification.Identifier(), e.Notification.DeviceToken(), e.Unwrap())
+}
+
+// Unwrap returns ErrorResponse if set, and Err otherwise
+func (e *SenderError) Unwrap() error {
+	if e.ErrorResponse != nil {
+		return e.ErrorResponse
+	}
+	return e.Err
+}
+
+// Class returns the ErrorClass of the error
+func (e *SenderError) Class() ErrorClass {
+	if e.ErrorResponse != nil {
+		return e.ErrorResponse.Status.Class()
+	}
+
+	var certErr *CertificateError
+	var retryErr *RetryError
+	var tokenErr *InvalidTokenError
+	var payloadErr *PayloadTooLargeError
+
+	switch {
+	case errors.As(e.Err, &certErr):
+		return FatalConfigErrorClass
+	case errors.As(e.Err, &retryErr):
+		return RetryableErrorClass
+	case errors.As(e.Err, &tokenErr):
+		return PermanentTokenErrorClass
+	case errors.As(e.Err, &payloadErr):
+		return PermanentPayloadErrorClass
+	}
+
+	return UnknownErrorClass
 }
 
 type readEvent struct {
 	resp *ErrorResponse
+	err  *ConnectionClosedError
 	conn conn
 }
 
@@ -47,32 +361,164 @@ func info(format string, v ...interface{}) {
 	}
 }
 
-// NewSender creates a new Sender
-func NewSender(ctx context.Context, addr string, cert *tls.Certificate) *Sender {
-	s := &Sender{
-		addr:       addr,
-		cert:       cert,
-		notifc:     make(chan *Notification),
-		prioNotifc: newPriochan(),
-		errorc:     make(chan *SenderError),
-		readc:      make(chan *readEvent),
-		newConn:    newConn,
-		donec:      make(chan struct{}),
+// NewSender creates a new Sender. It does not fail: if the check enabled by
+// SenderCheckCertificate fails, the error is logged and the Sender is started
+// anyway. Use StartSender to handle the error.
+func NewSender(ctx context.Context, addr string, cert *tls.Certificate, opts ...SenderOption) *Sender {
+	s := newSender(addr, cert, opts...)
+	if err := s.checkCertificate(); err != nil {
+		log.Printf("Certificate check failed: %v", err)
 	}
+	s.start(ctx)
+	return s
+}
 
-	s.prioNotifc.Add(s.notifc)
+// StartSender creates a new Sender. It returns an error if the check enabled
+// by SenderCheckCertificate fails.
+func StartSender(ctx context.Context, addr string, cert *tls.Certificate, opts ...SenderOption) (*Sender, error) {
+	s := newSender(addr, cert, opts...)
+	if err := s.checkCertificate(); err != nil {
+		return nil, err
+	}
+	s.start(ctx)
+	return s, nil
+}
 
-	go s.senderJob(ctx)
+func newSender(addr string, cert *tls.Certificate, opts ...SenderOption) *Sender {
+	s := &Sender{
+		addr:         addr,
+		cert:         cert,
+		acceptc:      make(chan *Notification),
+		shutdownc:    make(chan *shutdownRequest),
+		closingc:     make(chan struct{}),
+		abandonc:     make(chan struct{}),
+		pausec:       make(chan *pauseRequest),
+		readc:        make(chan *readEvent),
+		donec:        make(chan struct{}),
+		draining:     make(map[conn]time.Time),
+		drainTimeout: defaultDrainTimeout,
+		retryPolicy:  DefaultRetryPolicy(),
+		queue: queueConfig{
+			retention: defaultQueueRetention,
+		},
+		expiry: certificateExpiry{
+			thresholds: defaultCertificateExpiryThresholds,
+		},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
 
 	return s
 }
 
-// Notifications returns the channel to which to send notifications
+// checkCertificate checks the certificate if SenderCheckCertificate is used
+func (s *Sender) checkCertificate() error {
+	if !s.checkCert {
+		return nil
+	}
+
+	ci, err := InspectCertificate(s.cert)
+	if err != nil {
+		return err
+	}
+	return ci.CheckGateway(s.addr)
+}
+
+func (s *Sender) start(ctx context.Context) {
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+		return newConn(addr, cert, &s.dial, s.queue)
+	}
+
+	for i := range s.lanes.chans {
+		s.lanes.chans[i] = make(chan *Notification, s.bufferSize)
+	}
+	s.errorc = make(chan *SenderError, s.errorBuffer)
+	if s.onError != nil {
+		s.errorHandler = newDispatcher(func(v interface{}) {
+			s.onError(v.(*SenderError))
+		})
+		s.errorHandler.limit = defaultErrorHandlerQueue
+		if s.dropErrors {
+			s.errorHandler.limit = s.errorBuffer
+		}
+		s.errorHandler.drop = func(v interface{}) {
+			info("Error handler is busy; dropping the error of notification %v", v.(*SenderError).Notification.Identifier())
+			s.updateStats(func(stats *SenderStats) {
+				stats.DroppedErrors++
+			})
+		}
+	}
+
+	if s.onEvent != nil {
+		s.events = newDispatcher(func(v interface{}) {
+			s.onEvent(v.(*SenderEvent))
+		})
+	}
+
+	s.prioNotifc = newPriochan()
+	s.prioNotifc.Add(s.acceptc)
+
+	go s.accept()
+	go s.senderJob(ctx)
+}
+
+// Notifications returns the channel to which to send notifications. It is
+// the channel of NormalLane.
 func (s *Sender) Notifications() chan *Notification {
-	return s.notifc
+	return s.lanes.chans[NormalLane]
+}
+
+// LaneNotifications returns the channel to which to send notifications of
+// lane. If lane is not one of the known values of Lane, it panics with an error
+// wrapping ErrInvalidLane, since it can not return it like TrySendLane.
+func (s *Sender) LaneNotifications(lane Lane) chan *Notification {
+	if !lane.valid() {
+		panic(fmt.Errorf("%w %d", ErrInvalidLane, lane))
+	}
+	return s.lanes.chans[lane]
+}
+
+// TrySend queues n in NormalLane without waiting. It returns ErrSenderFull if
+// the buffer set with SenderBuffer is full (or if the Sender is busy, without
+// buffer), and ErrSenderClosed after Shutdown. With SenderValidateTokens, it
+// returns the *InvalidTokenError of an invalid token instead of queuing n.
+func (s *Sender) TrySend(n *Notification) error {
+	return s.TrySendLane(NormalLane, n)
+}
+
+// TrySendLane is like TrySend, for notifications of lane. It returns
+// ErrInvalidLane if lane is not one of the known values of Lane.
+func (s *Sender) TrySendLane(lane Lane, n *Notification) error {
+	if !lane.valid() {
+		return ErrInvalidLane
+	}
+
+	select {
+	case <-s.closingc:
+		return ErrSenderClosed
+	case <-s.donec:
+		return ErrSenderClosed
+	default:
+	}
+
+	if s.checkTokens {
+		if _, err := ParseDeviceToken(n.DeviceToken()); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case s.lanes.chans[lane] <- n:
+		return nil
+	default:
+		return ErrSenderFull
+	}
 }
 
-// Errors returns the channel from which to receive SenderErrors
+// Errors returns the channel from which to receive SenderErrors. Nothing is
+// sent to it if SenderErrorHandler is used.
 func (s *Sender) Errors() <-chan *SenderError {
 	return s.errorc
 }
@@ -83,39 +529,473 @@ func (s *Sender) Done() <-chan struct{} {
 	return s.donec
 }
 
+// Shutdown stops accepting notifications, sends the notifications already
+// accepted, and then waits for error-responses until ctx is done. Since APNs
+// does not acknowledge notifications, Shutdown always waits until ctx is done:
+// use a deadline. The Sender then terminates, like when the context passed to
+// NewSender is done.
+//
+// Shutdown returns the notifications whose fate is unknown: those sent
+// recently enough to still be rejected, and those that could not be sent
+// before ctx was done, in which case it also returns ctx.Err(). Notifications
+// sent to Notifications() after Shutdown was called are reported with
+// ErrSenderClosed rather than returned. Shutdown resumes a paused Sender. If
+// the context passed to NewSender is done first, Shutdown returns early with
+// its error.
+//
+// If the Sender is still busy when ctx is done (e.g. blocked writing, or
+// waiting for Errors() to be read), Shutdown returns ctx.Err() without the
+// unknown notifications, at most a second later. The Sender then terminates
+// as soon as it can, dropping the errors that nobody reads.
+func (s *Sender) Shutdown(ctx context.Context) ([]*Notification, error) {
+	req := &shutdownRequest{
+		ctx:     ctx,
+		resultc: make(chan *shutdownResult, 1),
+	}
+
+	// past the deadline of the first Shutdown, errors that nobody reads are
+	// dropped so that the Sender can terminate
+	s.shutdownOnce.Do(func() {
+		go func() {
+			select {
+			case <-ctx.Done():
+				close(s.abandonc)
+			case <-s.donec:
+			}
+		}()
+	})
+
+	select {
+	case s.shutdownc <- req:
+	case <-s.donec:
+		return nil, ErrSenderClosed
+	case <-ctx.Done():
+		// the Sender is busy; it shuts down once it handles the request
+		go func() {
+			select {
+			case s.shutdownc <- req:
+			case <-s.donec:
+			}
+		}()
+		return nil, ctx.Err()
+	}
+
+	select {
+	case res := <-req.resultc:
+		return res.unknown, res.err
+	case <-ctx.Done():
+	}
+
+	select {
+	case res := <-req.resultc:
+		return res.unknown, res.err
+	case <-time.After(shutdownGrace):
+		return nil, ctx.Err()
+	}
+}
+
+// Pause stops writing notifications until Resume is called. Notifications
+// sent to Notifications() and those requeued are kept, and error-responses are
+// still handled. The notification being written, if any, is written before
+// Pause returns, unless the Sender is waiting to connect again: it is then
+// kept with the others.
+func (s *Sender) Pause() {
+	s.requestPause(true)
+}
+
+// Resume resumes writing notifications after Pause
+func (s *Sender) Resume() {
+	s.requestPause(false)
+}
+
+func (s *Sender) requestPause(paused bool) {
+	req := &pauseRequest{paused: paused, donec: make(chan struct{})}
+
+	select {
+	case s.pausec <- req:
+		<-req.donec
+	case <-s.donec:
+	}
+}
+
+// SetCertificate replaces the client certificate. Notifications are then
+// written to a new connection using cert, while the current connection is
+// kept open for SenderDrainTimeout to receive its pending error-responses.
+func (s *Sender) SetCertificate(cert *tls.Certificate) {
+	s.certMu.Lock()
+	defer s.certMu.Unlock()
+
+	s.cert = cert
+	s.certGen++
+}
+
+// WatchCertificateFiles checks the modification time of files every interval,
+// until ctx is done. When one of them changes, load is called and its result is
+// passed to SetCertificate. If load fails, the error is logged and the current
+// certificate is kept.
+func (s *Sender) WatchCertificateFiles(ctx context.Context, interval time.Duration, load func() (*tls.Certificate, error), files ...string) {
+	modTimes := func() []time.Time {
+		var t []time.Time
+		for _, f := range files {
+			var mtime time.Time
+			if fi, err := os.Stat(f); err == nil {
+				mtime = fi.ModTime()
+			}
+			t = append(t, mtime)
+		}
+		return t
+	}
+
+	go func() {
+		last := modTimes()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current := modTimes()
+			changed := false
+			for i := range current {
+				if !current[i].Equal(last[i]) {
+					changed = true
+				}
+			}
+			if !changed {
+				continue
+			}
+
+			cert, err := load()
+			if err != nil {
+				log.Printf("Failed loading certificate: %v; keeping the current one", err)
+				continue
+			}
+
+			last = current
+			info("Certificate files changed; using the new certificate")
+			s.SetCertificate(cert)
+		}
+	}()
+}
+
+func (s *Sender) certificate() (*tls.Certificate, uint64) {
+	s.certMu.Lock()
+	defer s.certMu.Unlock()
+
+	return s.cert, s.certGen
+}
+
+func (s *Sender) emit(ev *SenderEvent) {
+	if s.events != nil {
+		s.events.Push(ev)
+	}
+}
+
+func (s *Sender) reportError(e *SenderError) {
+	s.updateStats(func(stats *SenderStats) {
+		stats.Failed++
+	})
+
+	switch {
+	case s.errorHandler != nil:
+		s.errorHandler.Push(e)
+	case s.dropErrors:
+		for {
+			select {
+			case s.errorc <- e:
+				return
+			default:
+			}
+			select {
+			case old := <-s.errorc:
+				info("Errors() is full; dropping the error of notification %v", old.Notification.Identifier())
+				s.updateStats(func(stats *SenderStats) {
+					stats.DroppedErrors++
+				})
+			default:
+			}
+		}
+	default:
+		select {
+		case s.errorc <- e:
+		case <-s.donec:
+		case <-s.abandonc:
+			info("Errors() is not read; dropping the error of notification %v", e.Notification.Identifier())
+		}
+	}
+}
+
+// checkCertificateExpiry warns once for each expiry threshold reached by the
+// current certificate
+func (s *Sender) checkCertificateExpiry() {
+	e := &s.expiry
+	cert, gen := s.certificate()
+
+	if !e.checked || e.gen != gen {
+		e.checked = true
+		e.gen = gen
+		e.notAfter = time.Time{}
+		e.warned = 0
+		e.expired = false
+		if leaf, err := certificateLeaf(cert); err == nil {
+			e.notAfter = leaf.NotAfter
+		}
+		s.updateStats(func(stats *SenderStats) {
+			stats.CertificateNotAfter = e.notAfter
+		})
+	}
+
+	if e.notAfter.IsZero() || e.expired {
+		return
+	}
+
+	now := time.Now()
+	left := e.notAfter.Sub(now)
+
+	if left <= 0 {
+		e.expired = true
+		log.Printf("Certificate expired on %v", e.notAfter.Format(time.RFC3339))
+		s.emit(&SenderEvent{Type: CertificateExpiredEvent, Time: now, NotAfter: e.notAfter})
+		return
+	}
+
+	reached := 0
+	for _, threshold := range e.thresholds {
+		if left <= threshold {
+			reached++
+		}
+	}
+
+	if reached > e.warned {
+		e.warned = reached
+		log.Printf("Certificate expires on %v", e.notAfter.Format(time.RFC3339))
+		s.emit(&SenderEvent{Type: CertificateExpiringEvent, Time: now, NotAfter: e.notAfter})
+	}
+}
+
+// accept forwards notifications from the lanes to the priochan, until
+// Shutdown is called
+func (s *Sender) accept() {
+	for {
+		n := s.lanes.next(s.closingc, s.donec)
+		if n == nil {
+			break
+		}
+		if !s.forward(n) {
+			return
+		}
+	}
+
+	// after Shutdown, only the notifications already buffered are sent
+	for _, n := range s.lanes.buffered() {
+		if !s.forward(n) {
+			return
+		}
+	}
+
+	close(s.acceptc)
+
+	for {
+		n := s.lanes.next(nil, s.donec)
+		if n == nil {
+			return
+		}
+		s.reject(n)
+	}
+}
+
+// forward hands n to senderJob. It returns false if the Sender terminated.
+func (s *Sender) forward(n *Notification) bool {
+	atomic.AddInt64(&s.pending, 1)
+
+	select {
+	case s.acceptc <- n:
+		return true
+	case <-s.donec:
+		return false
+	}
+}
+
+// reject reports n with ErrSenderClosed
+func (s *Sender) reject(n *Notification) {
+	info("Sender is shut down; rejecting notification %v", n.Identifier())
+	s.reportError(&SenderError{Notification: n, Err: ErrSenderClosed})
+}
+
 func (s *Sender) senderJob(ctx context.Context) {
 	ticker := time.Tick(time.Second)
 
+	s.checkCertificateExpiry()
+
 start:
 	for {
+		notifc := s.prioNotifc.Receive()
+		if s.paused {
+			notifc = nil
+		}
+
+		var shutdownDone <-chan struct{}
+		if s.shutdownReq != nil {
+			shutdownDone = s.shutdownReq.ctx.Done()
+		}
+
 		select {
 		case <-ctx.Done():
-			if s.conn != nil {
-				s.conn.Close()
+			if s.shutdownReq != nil {
+				res := s.shutdown(ctx)
+				res.err = ctx.Err()
+				s.shutdownReq.resultc <- res
+			} else {
+				s.stop()
 			}
-			s.prioNotifc.Close()
+			break start
+		case req := <-s.shutdownc:
+			s.acceptShutdown(req)
+		case req := <-s.pausec:
+			s.handlePause(req)
+		case <-shutdownDone:
+			s.shutdownReq.resultc <- s.shutdown(s.shutdownReq.ctx)
 			break start
 		case ev := <-s.readc:
 			s.handleRead(ev)
-		case n := <-s.prioNotifc.Receive():
-			if !n.HasIdentifier() {
-				n.SetIdentifier(s.nextId)
-				s.nextId++
+		case n := <-notifc:
+			s.doSend(ctx, n)
+			atomic.AddInt64(&s.pending, -1)
+			if req := s.heldShutdown; req != nil {
+				s.heldShutdown = nil
+				s.acceptShutdown(req)
+			}
+			if req := s.heldPause; req != nil {
+				s.heldPause = nil
+				s.handlePause(req)
 			}
-			info("Sending notification %v", n.Identifier())
-			s.doSend(n)
 		case <-ticker:
 			if s.conn != nil {
 				s.conn.Expire()
 			}
+			s.closeDrained()
+			s.checkCertificateExpiry()
 		}
+
+		s.updateQueueStats()
+	}
+
+	if s.events != nil {
+		s.events.Close()
+	}
+	if s.errorHandler != nil {
+		s.errorHandler.Close()
 	}
 
 	close(s.donec)
 }
 
+// acceptShutdown starts shutting down for req, or replies with ErrSenderClosed
+// if Shutdown was already called
+func (s *Sender) acceptShutdown(req *shutdownRequest) {
+	if s.shutdownReq != nil {
+		req.resultc <- &shutdownResult{err: ErrSenderClosed}
+		return
+	}
+
+	info("Shutting down")
+	s.shutdownReq = req
+	close(s.closingc)
+	s.setPaused(false)
+}
+
+// handlePause pauses or resumes for req, unless the Sender is shutting down
+func (s *Sender) handlePause(req *pauseRequest) {
+	if s.shutdownReq == nil {
+		s.setPaused(req.paused)
+	}
+	close(req.donec)
+}
+
+func (s *Sender) setPaused(paused bool) {
+	if paused == s.paused {
+		return
+	}
+	s.paused = paused
+
+	ev := &SenderEvent{Type: ResumedEvent, Time: time.Now()}
+	if paused {
+		info("Pausing")
+		ev.Type = PausedEvent
+		if s.pauseDrain && s.conn != nil {
+			s.drain()
+		}
+	} else {
+		info("Resuming")
+	}
+
+	s.updateStats(func(stats *SenderStats) {
+		stats.Paused = paused
+	})
+	s.emit(ev)
+}
+
+// stop closes the connections and the priochan
+func (s *Sender) stop() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	for c := range s.draining {
+		c.Close()
+	}
+	s.prioNotifc.Close()
+}
+
+// shutdown collects the notifications whose fate is unknown, and stops the
+// Sender
+func (s *Sender) shutdown(ctx context.Context) *shutdownResult {
+	res := &shutdownResult{}
+
+	for _, c := range s.conns() {
+		res.unknown = append(res.unknown, c.GetSentNotifications()...)
+	}
+
+	// notifications in hand when connecting was interrupted
+	if len(s.unsent) > 0 {
+		res.unknown = append(res.unknown, s.unsent...)
+		res.err = ctx.Err()
+	}
+
+	s.stop()
+
+	// the accept goroutine closed s.acceptc, so the priochan ends once the
+	// requeued notifications are consumed
+	for n := range s.prioNotifc.Receive() {
+		res.unknown = append(res.unknown, n)
+		res.err = ctx.Err()
+	}
+
+	// the accepted notifications are either sent or returned
+	atomic.StoreInt64(&s.pending, 0)
+
+	info("Shut down; the fate of %v notifications is unknown", len(res.unknown))
+
+	return res
+}
+
+// conns returns the current connection and the draining ones
+func (s *Sender) conns() []conn {
+	var conns []conn
+	if s.conn != nil {
+		conns = append(conns, s.conn)
+	}
+	for c := range s.draining {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
 func (s *Sender) handleRead(ev *readEvent) {
-	var n *Notification
+	var n, retry *Notification
 	var sent []*Notification
 	conn := ev.conn
 
@@ -123,6 +1003,12 @@ func (s *Sender) handleRead(ev *readEvent) {
 	if conn == s.conn {
 		s.conn = nil
 	}
+	delete(s.draining, conn)
+
+	if err := ev.err; err != nil && err.Reason != ErrorResponseCloseReason && err.Reason != LocalCloseReason {
+		info("Connection to %v closed: %v", s.addr, err)
+		s.emit(&SenderEvent{Type: ConnectionClosedEvent, Time: time.Now(), Err: err})
+	}
 
 	if resp := ev.resp; resp != nil {
 		n = conn.GetSentNotification(resp.Identifier)
@@ -132,13 +1018,19 @@ func (s *Sender) handleRead(ev *readEvent) {
 		} else {
 			info("Got a response for notification %v", resp.Identifier)
 
-			// for ShutdownErrorStatus, the Identifier indicates the last
-			// notification that was successfully sent
-			if resp.Status != ShutdownErrorStatus {
-				s.errorc <- &SenderError{
+			switch {
+			case resp.Status == ShutdownErrorStatus:
+				// for ShutdownErrorStatus, the Identifier indicates the last
+				// notification that was successfully sent
+			case resp.Status.Class() == RetryableErrorClass && n.errors < s.retryPolicy.MaxRetryableErrors:
+				info("Notification %v failed with %v; will retry", resp.Identifier, resp.Status)
+				n.errors++
+				retry = n
+			default:
+				s.reportError(&SenderError{
 					Notification:  n,
 					ErrorResponse: resp,
-				}
+				})
 			}
 		}
 	}
@@ -149,12 +1041,34 @@ func (s *Sender) handleRead(ev *readEvent) {
 		sent = conn.GetSentNotifications()
 	}
 
-	// requeue notifications before anything sent to s.notifc
+	if retry != nil {
+		sent = append([]*Notification{retry}, sent...)
+	}
+
+	now := time.Now()
+	var requeue []*Notification
+	for _, n := range sent {
+		if !s.dropExpired(n, now) {
+			requeue = append(requeue, n)
+		}
+	}
+	sent = requeue
+
+	atomic.AddInt64(&s.pending, int64(len(sent)))
+	s.updateStats(func(stats *SenderStats) {
+		stats.Requeued += len(sent)
+	})
+
+	s.requeue(sent)
+}
+
+// requeue sends notifications again before anything sent to the lanes
+func (s *Sender) requeue(notifs []*Notification) {
 	c := make(chan *Notification)
 	s.prioNotifc.Add(c)
 
 	go func() {
-		for _, n := range sent {
+		for _, n := range notifs {
 			info("Requeuing notification %v", n.Identifier())
 			c <- n
 		}
@@ -162,17 +1076,126 @@ func (s *Sender) handleRead(ev *readEvent) {
 	}()
 }
 
-func (s *Sender) doSend(n *Notification) {
+func (s *Sender) updateQueueStats() {
+	var count, bytes int
+	for _, c := range s.conns() {
+		n, b := c.Queued()
+		count += n
+		bytes += b
+	}
+
+	s.updateStats(func(stats *SenderStats) {
+		stats.SentQueueLen = count
+		stats.SentQueueBytes = bytes
+	})
+}
+
+// drain stops writing to the current connection, and closes it after
+// drainTimeout unless APNs closes it first
+func (s *Sender) drain() {
+	info("Draining connection to %v", s.addr)
+	s.draining[s.conn] = time.Now().Add(s.drainTimeout)
+	s.conn = nil
+}
+
+func (s *Sender) closeDrained() {
+	now := time.Now()
+	for c, deadline := range s.draining {
+		if now.After(deadline) {
+			info("Closing drained connection to %v", s.addr)
+			c.Close()
+			delete(s.draining, c)
+		}
+	}
+}
+
+func (s *Sender) doSend(ctx context.Context, n *Notification) {
+	var lastErr error
+
+	if s.checkTokens {
+		token, err := ParseDeviceToken(n.DeviceToken())
+		if err != nil {
+			info("%v; notification is lost", err)
+			s.reportError(&SenderError{
+				Notification: n,
+				Err:          err,
+			})
+			return
+		}
+		n.SetDeviceToken(token.String())
+	}
+
 	for {
-		s.connect()
+		if max := s.retryPolicy.MaxAttempts; max > 0 && n.attempts >= max {
+			info("Notification %v failed %v times; giving up", n.Identifier(), n.attempts)
+			s.reportError(&SenderError{
+				Notification: n,
+				Err:          &RetryError{Attempts: n.attempts, Err: lastErr},
+			})
+			return
+		}
+
+		if s.conn != nil {
+			if _, gen := s.certificate(); gen != s.connGen {
+				s.drain()
+			}
+		}
+
+		if err := s.connect(ctx); err == errInterrupted && s.heldPause != nil {
+			info("Stopped connecting to pause or resume")
+			atomic.AddInt64(&s.pending, 1)
+			s.requeue([]*Notification{n})
+			return
+		} else if err == errInterrupted {
+			info("Stopped connecting; notification %v was not sent", n.Identifier())
+			// it is still pending until Shutdown returns it
+			atomic.AddInt64(&s.pending, 1)
+			s.unsent = append(s.unsent, n)
+			return
+		} else if err != nil {
+			info("%v; notification %v is lost", err, n.Identifier())
+			if _, ok := err.(*CertificateError); !ok {
+				err = &RetryError{Attempts: n.attempts, Err: err}
+			}
+			s.reportError(&SenderError{
+				Notification: n,
+				Err:          err,
+			})
+			return
+		}
+
+		if !n.HasIdentifier() {
+			s.assignIdentifier(n)
+		} else if s.conn.GetSentNotification(n.Identifier()) != nil {
+			info("Notification %v has the same identifier as a notification in flight", n.Identifier())
+			s.reportError(&SenderError{
+				Notification: n,
+				Err:          ErrDuplicateIdentifier,
+			})
+			return
+		}
+
+		if s.dropExpired(n, time.Now()) {
+			return
+		}
+
+		info("Sending notification %v", n.Identifier())
+
+		n.attempts++
+		n.sentAt = time.Now()
 
 		if connError, err := s.conn.Write(n); err != nil {
 			if connError {
 				s.conn.Close()
 				s.conn = nil
+				lastErr = err
 				info("%v; will retry", err)
 			} else {
 				info("%v; notification is lost", err)
+				s.reportError(&SenderError{
+					Notification: n,
+					Err:          err,
+				})
 				return
 			}
 		} else {
@@ -181,22 +1204,95 @@ func (s *Sender) doSend(n *Notification) {
 	}
 }
 
-func (s *Sender) connect() {
+// dropExpired reports n with ErrExpired if it expired at now
+func (s *Sender) dropExpired(n *Notification, now time.Time) bool {
+	if !n.Expired(now) {
+		return false
+	}
+
+	info("Notification %v expired on %v; dropping it", n.Identifier(), n.Expiry().Format(time.RFC3339))
+	s.emit(&SenderEvent{
+		Type:         NotificationExpiredEvent,
+		Time:         now,
+		Notification: n,
+		Err:          ErrExpired,
+	})
+	s.reportError(&SenderError{
+		Notification: n,
+		Err:          ErrExpired,
+	})
+	return true
+}
+
+// assignIdentifier sets the next identifier not used by a notification in
+// flight on the current connection, which happens after wraparound
+func (s *Sender) assignIdentifier(n *Notification) {
+	for s.conn.GetSentNotification(s.nextId) != nil {
+		s.nextId++
+	}
+	n.SetIdentifier(s.nextId)
+	s.nextId++
+}
+
+// connect connects to APNs, retrying on network errors. It returns an error
+// if the certificate was rejected, or if the RetryPolicy gave up. It returns
+// errInterrupted if ctx is done, the shutdown deadline is reached, or a pause
+// request arrives first.
+func (s *Sender) connect(ctx context.Context) error {
+	if s.conn != nil {
+		return nil
+	}
+
+	ctx, stop := s.watchRequests(ctx)
+	defer stop()
+
 	for s.conn == nil {
 		var conn conn
+		var gen uint64
 		var err error
 
+		if s.certErr != nil {
+			if _, current := s.certificate(); current == s.certErrGen && time.Since(s.certErrAt) < certificateRetryInterval {
+				return s.certErr
+			}
+			s.certErr = nil
+		}
+
 		connect := func() error {
+			var cert *tls.Certificate
+			cert, gen = s.certificate()
 			info("Connecting to %v", s.addr)
-			conn, err = s.newConn(s.addr, s.cert)
+			conn, err = s.newConn(s.addr, cert)
 			if err != nil {
+				if _, ok := err.(*CertificateError); ok {
+					return backoff.Permanent(err)
+				}
 				info("Failed connecting to %v: %v; will retry", s.addr, err)
 				return err
 			}
 			return nil
 		}
 
-		if backoff.Retry(connect, backoff.NewExponentialBackOff()) != nil {
+		if err := backoff.Retry(connect, backoff.WithContext(s.retryPolicy.newBackOff(), ctx)); err != nil {
+			if certErr, ok := err.(*CertificateError); ok {
+				log.Printf("Failed connecting to %v: %v", s.addr, certErr)
+				s.certErr = certErr
+				s.certErrGen = gen
+				s.certErrAt = time.Now()
+				s.emit(&SenderEvent{
+					Type:     CertificateRejectedEvent,
+					Time:     s.certErrAt,
+					NotAfter: certErr.NotAfter,
+					Err:      certErr,
+				})
+				return certErr
+			}
+			if ctx.Err() != nil {
+				return errInterrupted
+			}
+			if s.retryPolicy.MaxElapsedTime > 0 {
+				return err
+			}
 			continue
 		}
 
@@ -205,6 +1301,57 @@ func (s *Sender) connect() {
 		go s.read(conn)
 
 		s.conn = conn
+		s.connGen = gen
+	}
+
+	return nil
+}
+
+// watchRequests returns a context that is done with ctx, at the shutdown
+// deadline, or when a pause request arrives, while senderJob is busy
+// connecting. Requests received meanwhile are kept in s.heldShutdown and
+// s.heldPause; the deadline of a held shutdown is watched too. The returned
+// function must be called once connecting is over.
+func (s *Sender) watchRequests(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	shutdown := s.shutdownReq
+	if shutdown == nil {
+		shutdown = s.heldShutdown
+	}
+	pause := s.heldPause
+	donec := make(chan struct{})
+
+	go func() {
+		defer close(donec)
+		for pause == nil {
+			shutdownc, pausec := s.shutdownc, s.pausec
+			var shutdownDone <-chan struct{}
+			if shutdown != nil {
+				// pause requests are ignored while shutting down
+				shutdownc, pausec = nil, nil
+				shutdownDone = shutdown.ctx.Done()
+			}
+
+			select {
+			case shutdown = <-shutdownc:
+			case pause = <-pausec:
+			case <-shutdownDone:
+				cancel()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+
+	return ctx, func() {
+		cancel()
+		<-donec
+		if shutdown != s.shutdownReq {
+			s.heldShutdown = shutdown
+		}
+		s.heldPause = pause
 	}
 }
 
@@ -214,7 +1361,7 @@ func (s *Sender) read(c conn) {
 		case <-c.Done():
 			return
 		case pnr := <-c.Read():
-			s.readc <- &readEvent{pnr, c}
+			s.readc <- &readEvent{pnr, c.Err(), c}
 		}
 	}
 }
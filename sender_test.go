@@ -1,9 +1,18 @@
 package apns
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
+	"fmt"
 	"log"
+	"math"
+	"math/big"
+	"sync"
 	"testing"
 	"time"
 
@@ -19,13 +28,14 @@ type mockConn struct {
 	donec chan struct{}
 	sent  *queue
 	write func(n *Notification) (bool, error)
+	err   *ConnectionClosedError
 }
 
 func newMockConn() *mockConn {
 	m := &mockConn{}
 	m.readc = make(chan *ErrorResponse)
 	m.donec = make(chan struct{})
-	m.sent = newQueue(time.Second * 300)
+	m.sent = newQueue(queueConfig{retention: time.Second * 300})
 	return m
 }
 
@@ -34,7 +44,7 @@ func (c *mockConn) Write(n *Notification) (connError bool, err error) {
 		connError, err = c.write(n)
 	}
 	if err == nil {
-		c.sent.Add(n)
+		c.sent.Add(n, nil)
 	}
 	return
 }
@@ -43,6 +53,10 @@ func (c *mockConn) Read() <-chan *ErrorResponse {
 	return c.readc
 }
 
+func (c *mockConn) Err() *ConnectionClosedError {
+	return c.err
+}
+
 func (c *mockConn) Done() <-chan struct{} {
 	return c.donec
 }
@@ -66,6 +80,10 @@ func (c *mockConn) GetSentNotifications() []*Notification {
 func (c *mockConn) Expire() {
 }
 
+func (c *mockConn) Queued() (count, bytes int) {
+	return c.sent.Len()
+}
+
 func createNotifs(num int) []*Notification {
 
 	n := []*Notification{}
@@ -349,3 +367,1460 @@ func TestSenderAssignsIdentifiers(t *testing.T) {
 
 	assert.Equal(t, []NotificationIdentifier{0, 1}, sent)
 }
+
+func TestStartSenderChecksCertificate(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cert, _, err := LoadPEMBundleFile("testdata/sandbox.pem", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = StartSender(ctx, SenderGateway, cert, SenderCheckCertificate())
+	assert.Error(t, err)
+
+	s, err := StartSender(ctx, SenderSandboxGateway, cert, SenderCheckCertificate())
+	assert.NoError(t, err)
+	assert.NotNil(t, s)
+
+	// NewSender only logs the failed check
+	s = NewSender(ctx, SenderGateway, cert, SenderCheckCertificate())
+	assert.NotNil(t, s)
+}
+
+func TestSenderSetCertificateDrainsConnection(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := "example.com:1234"
+	cert1 := &tls.Certificate{}
+	cert2 := &tls.Certificate{}
+
+	n := createNotifs(2)
+	mocks := []*mock.Mock{}
+	certs := []*tls.Certificate{}
+
+	var mu sync.Mutex
+	sent := []NotificationIdentifier{}
+	drained := false
+	sentCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent)
+	}
+	isDrained := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return drained
+	}
+
+	s := NewSender(ctx, addr, cert1, SenderDrainTimeout(time.Millisecond))
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+
+		c := newMockConn()
+
+		c.write = func(n *Notification) (connError bool, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			sent = append(sent, n.Identifier())
+			return
+		}
+
+		if len(certs) == 0 {
+			c.On("Close").Return().Once().Run(func(mock.Arguments) {
+				mu.Lock()
+				defer mu.Unlock()
+				drained = true
+			})
+		} else {
+			c.On("Close").Return().Once()
+		}
+
+		certs = append(certs, cert)
+		mocks = append(mocks, &c.Mock)
+		return c, nil
+	}
+
+	go drainErrors(s)
+
+	sendNotifs(s, n[:1])
+	waitUntil(func() bool { return sentCount() == 1 })
+
+	s.SetCertificate(cert2)
+
+	sendNotifs(s, n[1:])
+	waitUntil(func() bool { return sentCount() == 2 })
+	waitUntil(isDrained)
+
+	cancel()
+
+	<-s.Done()
+
+	for _, m := range mocks {
+		m.AssertExpectations(t)
+	}
+
+	assert.Equal(t, []NotificationIdentifier{0, 1}, sent)
+	if assert.Len(t, certs, 2) {
+		assert.True(t, certs[0] == cert1, "first connection uses the initial certificate")
+		assert.True(t, certs[1] == cert2, "second connection uses the new certificate")
+	}
+}
+
+func newTestCertificate(t *testing.T, notAfter time.Time) *tls.Certificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Apple Push Services: com.example.app"},
+		NotBefore:    notAfter.Add(-time.Hour * 24 * 365),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+func TestSenderWarnsBeforeCertificateExpiry(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notAfter := time.Now().Add(time.Hour * 24 * 5).Truncate(time.Second)
+	events := make(chan *SenderEvent, 10)
+
+	s := NewSender(ctx, "example.com:1234", newTestCertificate(t, notAfter),
+		SenderEventHandler(func(ev *SenderEvent) {
+			events <- ev
+		}))
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, CertificateExpiringEvent, ev.Type)
+		assert.True(t, notAfter.Equal(ev.NotAfter))
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the expiry event")
+	}
+
+	assert.True(t, notAfter.Equal(s.Stats().CertificateNotAfter))
+
+	// thresholds are only reported once
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event %v", ev)
+	case <-time.After(time.Millisecond * 1500):
+	}
+}
+
+func TestSenderReportsCertificateErrors(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := "example.com:1234"
+	cert := &tls.Certificate{}
+
+	n := createNotifs(2)
+	conns := 0
+	events := make(chan *SenderEvent, 10)
+
+	s := NewSender(ctx, addr, cert, SenderEventHandler(func(ev *SenderEvent) {
+		events <- ev
+	}))
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+		conns++
+		return nil, &CertificateError{Revoked: true, Err: errors.New("tls: certificate revoked")}
+	}
+
+	go sendNotifs(s, n)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-s.Errors():
+			assert.Equal(t, NotificationIdentifier(i), e.Notification.Identifier())
+			assert.Nil(t, e.ErrorResponse)
+			if certErr, ok := e.Err.(*CertificateError); assert.True(t, ok) {
+				assert.True(t, certErr.Revoked)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout waiting for the sender error")
+		}
+	}
+
+	ev := <-events
+	assert.Equal(t, CertificateRejectedEvent, ev.Type)
+
+	// the second notification failed without connecting again
+	assert.Equal(t, 1, conns)
+
+	cancel()
+
+	<-s.Done()
+}
+
+func TestSenderGivesUpAfterMaxAttempts(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := "example.com:1234"
+	cert := &tls.Certificate{}
+
+	n := createNotifs(1)
+	mocks := []*mock.Mock{}
+	writes := 0
+
+	s := NewSender(ctx, addr, cert, SenderRetryPolicy(RetryPolicy{MaxAttempts: 3}))
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+
+		c := newMockConn()
+
+		c.write = func(n *Notification) (connError bool, err error) {
+			writes++
+			return true, errors.New("broken pipe")
+		}
+
+		c.On("Close").Return().Once()
+
+		mocks = append(mocks, &c.Mock)
+		return c, nil
+	}
+
+	go sendNotifs(s, n)
+
+	select {
+	case e := <-s.Errors():
+		if retryErr, ok := e.Err.(*RetryError); assert.True(t, ok) {
+			assert.Equal(t, 3, retryErr.Attempts)
+			assert.EqualError(t, retryErr.Err, "broken pipe")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the sender error")
+	}
+
+	cancel()
+
+	<-s.Done()
+
+	for _, m := range mocks {
+		m.AssertExpectations(t)
+	}
+
+	assert.Equal(t, 3, writes)
+}
+
+func TestSenderGivesUpConnecting(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := "example.com:1234"
+	cert := &tls.Certificate{}
+
+	n := createNotifs(1)
+
+	s := NewSender(ctx, addr, cert, SenderRetryPolicy(RetryPolicy{
+		InitialInterval: time.Millisecond,
+		MaxInterval:     time.Millisecond * 10,
+		MaxElapsedTime:  time.Millisecond * 50,
+	}))
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+		return nil, errors.New("connection refused")
+	}
+
+	go sendNotifs(s, n)
+
+	select {
+	case e := <-s.Errors():
+		if retryErr, ok := e.Err.(*RetryError); assert.True(t, ok) {
+			assert.Equal(t, 0, retryErr.Attempts)
+			assert.EqualError(t, retryErr.Err, "connection refused")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the sender error")
+	}
+
+	cancel()
+
+	<-s.Done()
+}
+
+func TestSenderRequeuesRetryableErrors(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := "example.com:1234"
+	cert := &tls.Certificate{}
+
+	n := createNotifs(3)
+	mocks := []*mock.Mock{}
+	sent := []NotificationIdentifier{}
+
+	s := NewSender(ctx, addr, cert, SenderRetryPolicy(RetryPolicy{MaxRetryableErrors: 1}))
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+
+		c := newMockConn()
+
+		c.write = func(n *Notification) (connError bool, err error) {
+			sent = append(sent, n.Identifier())
+			if n.Identifier() == 1 {
+				go func() {
+					c.readc <- &ErrorResponse{
+						Command:    ErrorCommand,
+						Status:     ProcessingErrorStatus,
+						Identifier: 1,
+					}
+				}()
+			}
+			return
+		}
+
+		c.On("Close").Return().Once()
+
+		mocks = append(mocks, &c.Mock)
+		return c, nil
+	}
+
+	go sendNotifs(s, n)
+
+	// the first error is retried, the second one is reported
+	select {
+	case e := <-s.Errors():
+		assert.Equal(t, NotificationIdentifier(1), e.Notification.Identifier())
+		assert.Equal(t, RetryableErrorClass, e.Class())
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the sender error")
+	}
+
+	cancel()
+
+	<-s.Done()
+
+	for _, m := range mocks {
+		m.AssertExpectations(t)
+	}
+
+	writes := 0
+	for _, id := range sent {
+		if id == 1 {
+			writes++
+		}
+	}
+	assert.Equal(t, 2, writes)
+}
+
+func TestSenderIdentifierWraparound(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := "example.com:1234"
+	cert := &tls.Certificate{}
+
+	// a notification with a custom identifier, then two that wrap around
+	n := []*Notification{NewNotification(), NewNotification(), NewNotification()}
+	n[0].SetIdentifier(0)
+
+	mocks := []*mock.Mock{}
+
+	var mu sync.Mutex
+	sent := []NotificationIdentifier{}
+	sentCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent)
+	}
+
+	s := NewSender(ctx, addr, cert, func(s *Sender) {
+		s.nextId = NotificationIdentifier(math.MaxUint32)
+	})
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+
+		c := newMockConn()
+
+		c.write = func(n *Notification) (connError bool, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			sent = append(sent, n.Identifier())
+			return
+		}
+
+		c.On("Close").Return().Once()
+
+		mocks = append(mocks, &c.Mock)
+		return c, nil
+	}
+
+	go sendNotifs(s, n)
+	go drainErrors(s)
+
+	waitUntil(func() bool { return sentCount() == 3 })
+
+	cancel()
+
+	<-s.Done()
+
+	for _, m := range mocks {
+		m.AssertExpectations(t)
+	}
+
+	assert.Equal(t, []NotificationIdentifier{0, math.MaxUint32, 1}, sent)
+}
+
+func TestSenderRejectsDuplicateIdentifiers(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := "example.com:1234"
+	cert := &tls.Certificate{}
+
+	n := append(createNotifs(2), createNotifs(1)...)
+	sent := []NotificationIdentifier{}
+
+	s := NewSender(ctx, addr, cert)
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+
+		c := newMockConn()
+
+		c.write = func(n *Notification) (connError bool, err error) {
+			sent = append(sent, n.Identifier())
+			return
+		}
+
+		c.On("Close").Return()
+
+		return c, nil
+	}
+
+	go sendNotifs(s, n)
+
+	select {
+	case e := <-s.Errors():
+		assert.True(t, e.Notification == n[2])
+		assert.Equal(t, ErrDuplicateIdentifier, e.Err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the sender error")
+	}
+
+	cancel()
+
+	<-s.Done()
+
+	assert.Equal(t, []NotificationIdentifier{0, 1}, sent)
+}
+
+func TestSenderDropsExpiredNotifications(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := "example.com:1234"
+	cert := &tls.Certificate{}
+
+	n := createNotifs(3)
+	n[1].SetTTL(-time.Minute)
+
+	var mu sync.Mutex
+	sent := []NotificationIdentifier{}
+	sentCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent)
+	}
+	events := make(chan *SenderEvent, 10)
+
+	s := NewSender(ctx, addr, cert, SenderEventHandler(func(ev *SenderEvent) {
+		events <- ev
+	}))
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+
+		c := newMockConn()
+
+		c.write = func(n *Notification) (connError bool, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			sent = append(sent, n.Identifier())
+			return
+		}
+
+		c.On("Close").Return()
+
+		return c, nil
+	}
+
+	go sendNotifs(s, n)
+
+	select {
+	case e := <-s.Errors():
+		assert.True(t, e.Notification == n[1])
+		assert.True(t, errors.Is(e, ErrExpired))
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the sender error")
+	}
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, NotificationExpiredEvent, ev.Type)
+		assert.True(t, ev.Notification == n[1])
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the event")
+	}
+
+	waitUntil(func() bool { return sentCount() == 2 })
+
+	cancel()
+
+	<-s.Done()
+
+	assert.Equal(t, []NotificationIdentifier{0, 2}, sent)
+}
+
+func TestSenderDoesNotRequeueExpiredNotifications(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := "example.com:1234"
+	cert := &tls.Certificate{}
+
+	n := createNotifs(3)
+	n[1].SetTTL(time.Millisecond * 200)
+
+	conns := 0
+
+	var mu sync.Mutex
+	sent := []NotificationIdentifier{}
+	sentCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent)
+	}
+
+	s := NewSender(ctx, addr, cert)
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+
+		c := newMockConn()
+
+		switch conns {
+		case 0:
+
+			c.write = func(n *Notification) (connError bool, err error) {
+				if n.Identifier() == 2 {
+					go func() {
+						// n[1] expires while waiting for the error-response
+						time.Sleep(time.Millisecond * 500)
+						c.readc <- &ErrorResponse{Identifier: 0, Status: InvalidTokenErrorStatus}
+					}()
+				}
+				return
+			}
+
+		case 1:
+
+			c.write = func(n *Notification) (connError bool, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				sent = append(sent, n.Identifier())
+				return
+			}
+		}
+
+		c.On("Close").Return()
+
+		conns += 1
+
+		return c, nil
+	}
+
+	go sendNotifs(s, n)
+
+	errs := []error{}
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-s.Errors():
+			errs = append(errs, e.Unwrap())
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout waiting for the sender errors")
+		}
+	}
+
+	waitUntil(func() bool { return sentCount() == 1 })
+
+	cancel()
+
+	<-s.Done()
+
+	assert.True(t, errors.Is(errs[0], ErrInvalidToken))
+	assert.Equal(t, ErrExpired, errs[1])
+	assert.Equal(t, []NotificationIdentifier{2}, sent)
+}
+
+func TestSenderReportsSentQueueDepth(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := "example.com:1234"
+	cert := &tls.Certificate{}
+
+	s := NewSender(ctx, addr, cert)
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+		c := newMockConn()
+		c.On("Close").Return()
+		return c, nil
+	}
+
+	go sendNotifs(s, createNotifs(3))
+	go drainErrors(s)
+
+	waitUntil(func() bool { return s.Stats().SentQueueLen == 3 })
+
+	cancel()
+
+	<-s.Done()
+
+	assert.Equal(t, 3, s.Stats().SentQueueLen)
+}
+
+func TestSenderQueueRetention(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addr := "example.com:1234"
+	cert := &tls.Certificate{}
+
+	s := NewSender(ctx, addr, cert, SenderQueueRetention(time.Minute*5))
+	assert.Equal(t, time.Minute*5, s.queue.retention)
+
+	s = NewSender(ctx, addr, cert, SenderQueueRetention(0))
+	assert.Equal(t, defaultQueueRetention, s.queue.retention)
+}
+
+func TestSenderReportsConnectionClosed(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := "example.com:1234"
+	cert := &tls.Certificate{}
+
+	events := make(chan *SenderEvent, 10)
+
+	s := NewSender(ctx, addr, cert, SenderEventHandler(func(ev *SenderEvent) {
+		events <- ev
+	}))
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+
+		c := newMockConn()
+
+		c.write = func(n *Notification) (connError bool, err error) {
+			if n.Identifier() == 0 {
+				go func() {
+					c.err = &ConnectionClosedError{Reason: EOFCloseReason}
+					c.readc <- nil
+				}()
+			}
+			return
+		}
+
+		c.On("Close").Return()
+
+		return c, nil
+	}
+
+	go sendNotifs(s, createNotifs(1))
+	go drainErrors(s)
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, ConnectionClosedEvent, ev.Type)
+		var err *ConnectionClosedError
+		if assert.True(t, errors.As(ev.Err, &err)) {
+			assert.Equal(t, EOFCloseReason, err.Reason)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the event")
+	}
+
+	cancel()
+
+	<-s.Done()
+}
+
+func TestSenderIgnoresLocalCloses(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := "example.com:1234"
+	cert := &tls.Certificate{}
+
+	events := make(chan *SenderEvent, 10)
+	conns := 0
+
+	s := NewSender(ctx, addr, cert, SenderEventHandler(func(ev *SenderEvent) {
+		events <- ev
+	}))
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+
+		c := newMockConn()
+		first := conns == 0
+		conns += 1
+
+		// the first connection is closed locally, and the second one by APNs
+		closed := false
+		c.write = func(n *Notification) (connError bool, err error) {
+			reason := EOFCloseReason
+			if first {
+				reason = LocalCloseReason
+			} else if n.Identifier() != 1 {
+				return
+			}
+			if !closed {
+				closed = true
+				go func() {
+					c.err = &ConnectionClosedError{Reason: reason}
+					c.readc <- nil
+				}()
+			}
+			return
+		}
+
+		c.On("Close").Return()
+
+		return c, nil
+	}
+
+	go sendNotifs(s, createNotifs(2))
+	go drainErrors(s)
+
+	// the second connection is opened once the first one was handled, so the
+	// first event is for the second one
+	select {
+	case ev := <-events:
+		assert.Equal(t, ConnectionClosedEvent, ev.Type)
+		var err *ConnectionClosedError
+		if assert.True(t, errors.As(ev.Err, &err)) {
+			assert.Equal(t, EOFCloseReason, err.Reason)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the event")
+	}
+
+	cancel()
+
+	<-s.Done()
+}
+
+func TestSenderValidatesTokens(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := "example.com:1234"
+	cert := &tls.Certificate{}
+
+	n := createNotifs(2)
+	n[0].SetDeviceToken("<740f4707 bebcf74f 9b7c25d4 8e335894 5f6aa01d a5ddb387 462c7eaf 61bb78ad>")
+	n[1].SetDeviceToken("740f4707")
+
+	sent := []string{}
+
+	s := NewSender(ctx, addr, cert, SenderValidateTokens())
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+
+		c := newMockConn()
+
+		c.write = func(n *Notification) (connError bool, err error) {
+			sent = append(sent, n.DeviceToken())
+			return
+		}
+
+		c.On("Close").Return()
+
+		return c, nil
+	}
+
+	go sendNotifs(s, n)
+
+	select {
+	case e := <-s.Errors():
+		assert.True(t, e.Notification == n[1])
+		assert.True(t, errors.Is(e, ErrInvalidTokenSize))
+		assert.Equal(t, PermanentTokenErrorClass, e.Class())
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the sender error")
+	}
+
+	cancel()
+
+	<-s.Done()
+
+	assert.Equal(t, []string{"740f4707bebcf74f9b7c25d48e3358945f6aa01da5ddb387462c7eaf61bb78ad"}, sent)
+}
+
+func TestSenderTrySendValidatesTokens(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := "example.com:1234"
+	cert := &tls.Certificate{}
+
+	n := createNotifs(2)
+	n[0].SetDeviceToken("740f4707")
+	n[1].SetDeviceToken("740f4707bebcf74f9b7c25d48e3358945f6aa01da5ddb387462c7eaf61bb78ad")
+
+	s := NewSender(ctx, addr, cert, SenderValidateTokens(), SenderBuffer(1))
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+		c := newMockConn()
+		c.On("Close").Return()
+		return c, nil
+	}
+
+	go drainErrors(s)
+
+	err := s.TrySend(n[0])
+	var tokenErr *InvalidTokenError
+	if assert.True(t, errors.As(err, &tokenErr)) {
+		assert.Equal(t, "740f4707", tokenErr.Token)
+	}
+	assert.NoError(t, s.TrySend(n[1]))
+
+	cancel()
+
+	<-s.Done()
+}
+
+func TestSenderShutdown(t *testing.T) {
+
+	n := createNotifs(4)
+
+	s, r := newRecordingSender(context.Background())
+	r.onWrite = func(c *mockConn, dial int, n *Notification) {
+		if dial == 1 && n.Identifier() == 2 {
+			go func() {
+				c.readc <- &ErrorResponse{Command: ErrorCommand, Status: InvalidTokenErrorStatus, Identifier: 0}
+			}()
+		}
+	}
+
+	sendNotifs(s, n[:3])
+
+	errs := make(chan *SenderError, 10)
+	go func() {
+		for e := range s.Errors() {
+			errs <- e
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+
+	type result struct {
+		unknown []*Notification
+		err     error
+	}
+	resultc := make(chan result)
+
+	go func() {
+		unknown, err := s.Shutdown(ctx)
+		resultc <- result{unknown, err}
+	}()
+
+	// n[3] is sent once the Sender is shutting down
+	<-s.closingc
+	s.Notifications() <- n[3]
+
+	var res result
+	select {
+	case res = <-resultc:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for Shutdown")
+	}
+
+	<-s.Done()
+
+	assert.NoError(t, res.err)
+	// 0 was rejected, and 1 and 2 were sent again
+	assert.Equal(t, []NotificationIdentifier{0, 1, 2, 1, 2}, r.sent())
+	assert.Equal(t, []*Notification{n[1], n[2]}, res.unknown)
+
+	var reported []error
+	for len(reported) < 2 {
+		select {
+		case e := <-errs:
+			reported = append(reported, e.Unwrap())
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout waiting for the sender errors")
+		}
+	}
+	assert.Contains(t, reported, ErrSenderClosed)
+
+	_, err := s.Shutdown(context.Background())
+	assert.Equal(t, ErrSenderClosed, err)
+}
+
+func TestSenderShutdownWithContinuousProducer(t *testing.T) {
+
+	s, r := newRecordingSender(context.Background(), SenderBuffer(100))
+
+	go drainErrors(s)
+
+	stopc := make(chan struct{})
+	defer close(stopc)
+
+	go func() {
+		for {
+			select {
+			case s.Notifications() <- NewNotification():
+			case <-stopc:
+				return
+			}
+		}
+	}()
+
+	waitUntil(func() bool { return len(r.sent()) > 0 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+
+	donec := make(chan struct{})
+	go func() {
+		s.Shutdown(ctx)
+		close(donec)
+	}()
+
+	select {
+	case <-donec:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for Shutdown")
+	}
+
+	<-s.Done()
+}
+
+func TestSenderShutdownWithoutErrorsReader(t *testing.T) {
+
+	// nobody reads Errors(), so the sender blocks reporting the first error
+	s, writes := newFailingSender(context.Background())
+
+	sendNotifs(s, createNotifs(2))
+	waitUntil(func() bool { return writes() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+
+	start := time.Now()
+	_, err := s.Shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Millisecond*300+shutdownGrace)
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the sender to stop")
+	}
+}
+
+func TestSenderShutdownInterrupted(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s, _ := newRecordingSender(ctx)
+
+	n := createNotifs(1)
+	sendNotifs(s, n)
+
+	errc := make(chan error, 1)
+	go func() {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Minute)
+		defer shutdownCancel()
+		_, err := s.Shutdown(shutdownCtx)
+		errc <- err
+	}()
+
+	<-s.closingc
+	cancel()
+
+	select {
+	case err := <-errc:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for Shutdown")
+	}
+
+	<-s.Done()
+}
+
+func TestSenderShutdownWhileConnecting(t *testing.T) {
+
+	s, r := newRecordingSender(context.Background())
+	r.setRefused(true)
+
+	n := createNotifs(1)
+	sendNotifs(s, n)
+
+	// let the sender retry connecting before shutting down
+	waitUntil(func() bool { return r.dialed() >= 2 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+
+	type result struct {
+		unknown []*Notification
+		err     error
+	}
+	resultc := make(chan result, 1)
+
+	go func() {
+		unknown, err := s.Shutdown(ctx)
+		resultc <- result{unknown, err}
+	}()
+
+	select {
+	case res := <-resultc:
+		assert.Equal(t, context.DeadlineExceeded, res.err)
+		assert.Equal(t, n, res.unknown)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for Shutdown")
+	}
+
+	<-s.Done()
+}
+
+func TestSenderStopsConnectingWhenDone(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s, r := newRecordingSender(ctx)
+	r.setRefused(true)
+
+	sendNotifs(s, createNotifs(1))
+	waitUntil(func() bool { return r.dialed() >= 1 })
+
+	cancel()
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the sender to stop")
+	}
+}
+
+func TestSenderPauseResume(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	n := createNotifs(4)
+	events := make(chan *SenderEvent, 10)
+
+	s, r := newRecordingSender(ctx, SenderDisconnectWhenPaused(), SenderDrainTimeout(0),
+		SenderEventHandler(func(ev *SenderEvent) {
+			events <- ev
+		}))
+
+	go drainErrors(s)
+
+	sendNotifs(s, n[:2])
+	waitUntil(func() bool { return len(r.sent()) == 2 })
+
+	s.Pause()
+	assert.True(t, s.Stats().Paused)
+
+	go sendNotifs(s, n[2:])
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, PausedEvent, ev.Type)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the event")
+	}
+
+	// the idle connection was drained and closed, and the other notifications
+	// are kept
+	waitUntil(func() bool { return r.closed() == 1 && s.Stats().Buffered == 2 })
+	assert.Equal(t, 1, r.closed())
+	assert.Equal(t, 2, s.Stats().Buffered)
+	assert.Len(t, r.sent(), 2)
+
+	s.Resume()
+	assert.False(t, s.Stats().Paused)
+
+	waitUntil(func() bool { return len(r.sent()) == 4 })
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, ResumedEvent, ev.Type)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the event")
+	}
+
+	cancel()
+
+	<-s.Done()
+
+	assert.Equal(t, []NotificationIdentifier{0, 1, 2, 3}, r.sent())
+	assert.Equal(t, 2, r.dialed())
+}
+
+// newFailingSender returns a Sender whose writes all fail without closing the
+// connection, and a function returning the number of writes
+func newFailingSender(ctx context.Context, opts ...SenderOption) (*Sender, func() int) {
+
+	var mu sync.Mutex
+	writes := 0
+
+	s := NewSender(ctx, "example.com:1234", &tls.Certificate{}, opts...)
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+
+		c := newMockConn()
+
+		c.write = func(n *Notification) (connError bool, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			writes++
+			return false, errors.New("some error")
+		}
+
+		c.On("Close").Return()
+
+		return c, nil
+	}
+
+	return s, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return writes
+	}
+}
+
+// recorder records the notifications written by the mock connections of a
+// Sender created with newRecordingSender
+type recorder struct {
+	mu      sync.Mutex
+	ids     []NotificationIdentifier
+	dials   int
+	closes  int
+	refused bool
+	// onWrite, if set, is called with the connection and the number of the
+	// dial that created it before each write
+	onWrite func(c *mockConn, dial int, n *Notification)
+}
+
+// newRecordingSender returns a Sender whose connections record the identifiers
+// of the notifications they write
+func newRecordingSender(ctx context.Context, opts ...SenderOption) (*Sender, *recorder) {
+
+	r := &recorder{}
+
+	s := NewSender(ctx, "example.com:1234", &tls.Certificate{}, opts...)
+	s.newConn = func(addr string, cert *tls.Certificate) (conn, error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.dials++
+		dial := r.dials
+		if r.refused {
+			return nil, errors.New("connection refused")
+		}
+
+		c := newMockConn()
+
+		c.write = func(n *Notification) (connError bool, err error) {
+			r.mu.Lock()
+			onWrite := r.onWrite
+			r.ids = append(r.ids, n.Identifier())
+			r.mu.Unlock()
+
+			if onWrite != nil {
+				onWrite(c, dial, n)
+			}
+			return
+		}
+
+		c.On("Close").Return().Run(func(mock.Arguments) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.closes++
+		})
+
+		return c, nil
+	}
+
+	return s, r
+}
+
+// sent returns the identifiers of the notifications written so far
+func (r *recorder) sent() []NotificationIdentifier {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]NotificationIdentifier{}, r.ids...)
+}
+
+// dialed returns the number of connection attempts
+func (r *recorder) dialed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dials
+}
+
+// closed returns the number of connections closed by the Sender
+func (r *recorder) closed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closes
+}
+
+// setRefused makes the following connection attempts fail, or succeed again
+func (r *recorder) setRefused(refused bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refused = refused
+}
+
+func TestSenderPausesWhileConnecting(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	n := createNotifs(1)
+
+	s, r := newRecordingSender(ctx)
+	r.setRefused(true)
+
+	go drainErrors(s)
+
+	sendNotifs(s, n)
+	waitUntil(func() bool { return r.dialed() >= 1 })
+
+	pausedc := make(chan struct{})
+	go func() {
+		s.Pause()
+		close(pausedc)
+	}()
+
+	select {
+	case <-pausedc:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for Pause")
+	}
+	assert.True(t, s.Stats().Paused)
+
+	r.setRefused(false)
+
+	// the notification is kept, and sent after Resume
+	assert.Equal(t, 1, s.Stats().Buffered)
+	assert.Empty(t, r.sent())
+
+	s.Resume()
+	waitUntil(func() bool { return len(r.sent()) == 1 })
+
+	cancel()
+
+	<-s.Done()
+
+	assert.Equal(t, []NotificationIdentifier{0}, r.sent())
+}
+
+func TestSenderDropsOldestErrors(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s, writes := newFailingSender(ctx, SenderErrorDropOldest(2))
+
+	sendNotifs(s, createNotifs(5))
+	waitUntil(func() bool { return writes() == 5 && s.Stats().DroppedErrors == 3 })
+
+	assert.Equal(t, 3, s.Stats().DroppedErrors)
+	assert.Equal(t, NotificationIdentifier(3), (<-s.Errors()).Notification.Identifier())
+	assert.Equal(t, NotificationIdentifier(4), (<-s.Errors()).Notification.Identifier())
+
+	cancel()
+
+	<-s.Done()
+}
+
+func TestSenderErrorHandler(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	block := make(chan struct{})
+	handled := make(chan NotificationIdentifier, 10)
+
+	s, writes := newFailingSender(ctx, SenderErrorHandler(func(e *SenderError) {
+		<-block
+		handled <- e.Notification.Identifier()
+	}))
+
+	// a slow handler does not stall the Sender
+	sendNotifs(s, createNotifs(3))
+	waitUntil(func() bool { return writes() == 3 })
+	assert.Equal(t, 3, writes())
+
+	close(block)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case id := <-handled:
+			assert.Equal(t, NotificationIdentifier(i), id)
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout waiting for the error handler")
+		}
+	}
+
+	cancel()
+
+	<-s.Done()
+}
+
+func TestSenderErrorHandlerDropsOldest(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	started := make(chan struct{}, 10)
+	block := make(chan struct{})
+	handled := make(chan NotificationIdentifier, 10)
+
+	s, writes := newFailingSender(ctx, SenderErrorDropOldest(2), SenderErrorHandler(func(e *SenderError) {
+		started <- struct{}{}
+		<-block
+		handled <- e.Notification.Identifier()
+	}))
+
+	n := createNotifs(10)
+
+	// the handler blocks on the first error, and only the last two of the
+	// others are kept
+	sendNotifs(s, n[:1])
+	<-started
+	sendNotifs(s, n[1:])
+	waitUntil(func() bool { return writes() == 10 && s.Stats().DroppedErrors == 7 })
+
+	assert.Equal(t, 7, s.Stats().DroppedErrors)
+
+	close(block)
+
+	for _, expected := range []NotificationIdentifier{0, 8, 9} {
+		select {
+		case id := <-handled:
+			assert.Equal(t, expected, id)
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout waiting for the error handler")
+		}
+	}
+
+	cancel()
+
+	<-s.Done()
+}
+
+func TestSenderTrySend(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s, r := newRecordingSender(ctx, SenderBuffer(2))
+
+	go drainErrors(s)
+
+	s.Pause()
+
+	queued := 0
+	for _, n := range createNotifs(10) {
+		if err := s.TrySend(n); err != nil {
+			assert.Equal(t, ErrSenderFull, err)
+			break
+		}
+		queued++
+	}
+
+	// the Sender may still be taking a notification from the buffer
+	waitUntil(func() bool { return s.Stats().Buffered == queued })
+
+	assert.True(t, queued >= 2 && queued < 10, "queued %v notifications", queued)
+	assert.Equal(t, queued, s.Stats().Buffered)
+	assert.Empty(t, r.sent())
+
+	s.Resume()
+
+	waitUntil(func() bool { return s.Stats().SentQueueLen == queued })
+
+	stats := s.Stats()
+	assert.Equal(t, 0, stats.Buffered)
+	assert.Equal(t, queued, stats.SentQueueLen)
+
+	cancel()
+
+	<-s.Done()
+
+	assert.Equal(t, ErrSenderClosed, s.TrySend(NewNotification()))
+}
+
+func TestSenderCountsRequeuedAndFailed(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s, r := newRecordingSender(ctx)
+	r.onWrite = func(c *mockConn, dial int, n *Notification) {
+		if dial == 1 && n.Identifier() == 2 {
+			go func() {
+				c.readc <- &ErrorResponse{Command: ErrorCommand, Status: InvalidTokenErrorStatus, Identifier: 0}
+			}()
+		}
+	}
+
+	go sendNotifs(s, createNotifs(3))
+	go drainErrors(s)
+
+	waitUntil(func() bool { return s.Stats().Requeued == 2 && s.Stats().SentQueueLen == 2 })
+
+	stats := s.Stats()
+	assert.Equal(t, 2, stats.Requeued)
+	assert.Equal(t, 1, stats.Failed)
+	assert.Equal(t, 2, stats.SentQueueLen)
+
+	cancel()
+
+	<-s.Done()
+}
+
+func TestSenderLanes(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s, r := newRecordingSender(ctx, SenderBuffer(10))
+
+	go drainErrors(s)
+
+	s.Pause()
+
+	n := createNotifs(7)
+	for _, n := range n[:6] {
+		assert.NoError(t, s.TrySendLane(BulkLane, n))
+	}
+	s.LaneNotifications(TransactionalLane) <- n[6]
+
+	s.Resume()
+
+	waitUntil(func() bool { return len(r.sent()) == 7 })
+
+	cancel()
+
+	<-s.Done()
+
+	sent := r.sent()
+
+	// at most two bulk notifications were already taken from the lane when
+	// the transactional one was sent
+	pos := -1
+	for i, id := range sent {
+		if id == 6 {
+			pos = i
+		}
+	}
+	assert.True(t, pos >= 0 && pos <= 2, "sent %v", sent)
+}
+
+func TestSenderInvalidLanes(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := NewSender(ctx, "example.com:1234", &tls.Certificate{})
+
+	for _, lane := range []Lane{-1, laneCount} {
+		assert.Equal(t, ErrInvalidLane, s.TrySendLane(lane, NewNotification()))
+		assert.PanicsWithError(t, fmt.Sprintf("%v %d", ErrInvalidLane, lane), func() { s.LaneNotifications(lane) })
+	}
+
+	cancel()
+
+	<-s.Done()
+}
@@ -0,0 +1,49 @@
+package apns
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SenderStats is a snapshot of the state of a Sender
+type SenderStats struct {
+	// CertificateNotAfter is the expiry of the current certificate, or zero if
+	// it could not be parsed
+	CertificateNotAfter time.Time
+	// Buffered is the number of notifications waiting to be written,
+	// including those in the lane channels and requeued ones
+	Buffered int
+	// SentQueueLen is the number of notifications in flight: sent recently
+	// and kept in case APNs reports an error. SentQueueBytes is their encoded
+	// size.
+	SentQueueLen   int
+	SentQueueBytes int
+	// Requeued is the number of notifications requeued after a connection
+	// was closed, and Failed the number of SenderErrors reported
+	Requeued int
+	Failed   int
+	// Paused is whether Pause was called without Resume
+	Paused bool
+	// DroppedErrors is the number of errors dropped because of
+	// SenderErrorDropOldest, or because the function of SenderErrorHandler
+	// could not keep up
+	DroppedErrors int
+}
+
+// Stats returns a snapshot of the state of the Sender
+func (s *Sender) Stats() SenderStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	stats := s.stats
+	stats.Buffered = s.lanes.len() + int(atomic.LoadInt64(&s.pending))
+
+	return stats
+}
+
+func (s *Sender) updateStats(f func(stats *SenderStats)) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	f(&s.stats)
+}
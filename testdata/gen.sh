@@ -0,0 +1,26 @@
+#!/bin/sh
+# Regenerates the test certificates. Run from the testdata directory.
+set -e
+
+openssl req -x509 -newkey rsa:2048 -nodes -days 36500 \
+	-subj "/UID=com.example.app/CN=Apple Push Services: com.example.app/OU=ABCDE12345/O=Example/C=US" \
+	-keyout key.pem -out cert.pem
+
+openssl rsa -in key.pem -traditional -aes256 -passout pass:secret -out key-encrypted.pem
+openssl pkcs8 -topk8 -in key.pem -v2 aes256 -passout pass:secret -out key-pkcs8-encrypted.pem
+
+cat cert.pem key-pkcs8-encrypted.pem > bundle.pem
+
+openssl pkcs12 -export -in cert.pem -inkey key.pem -passout pass:secret -out cert.p12
+
+openssl req -x509 -newkey rsa:2048 -nodes -days 36500 -config apns.cnf -extensions sandbox \
+	-subj "/UID=com.example.app/CN=Apple Development IOS Push Services: com.example.app/OU=ABCDE12345/O=Example/C=US" \
+	-keyout sandbox-key.pem -out sandbox.pem
+cat sandbox-key.pem >> sandbox.pem
+rm sandbox-key.pem
+
+openssl req -x509 -newkey rsa:2048 -nodes -days 36500 -config apns.cnf -extensions universal \
+	-subj "/UID=com.example.app/CN=Apple Push Services: com.example.app/OU=ABCDE12345/O=Example/C=US" \
+	-keyout universal-key.pem -out universal.pem
+cat universal-key.pem >> universal.pem
+rm universal-key.pem
@@ -0,0 +1,127 @@
+package apns
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultDialTimeout      = 30 * time.Second
+	defaultHandshakeTimeout = 30 * time.Second
+)
+
+// dialConfig holds the settings used to connect to APNs
+type dialConfig struct {
+	tlsConfig        *tls.Config
+	dialer           Dialer
+	dialTimeout      time.Duration
+	handshakeTimeout time.Duration
+}
+
+// dial opens a TCP connection to addr. A nil dialConfig uses the defaults.
+func (dc *dialConfig) dial(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer Dialer = &net.Dialer{}
+	timeout := defaultDialTimeout
+
+	if dc != nil {
+		if dc.dialer != nil {
+			dialer = dc.dialer
+		}
+		if dc.dialTimeout != 0 {
+			timeout = dc.dialTimeout
+		}
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+func (dc *dialConfig) getHandshakeTimeout() time.Duration {
+	if dc != nil && dc.handshakeTimeout != 0 {
+		return dc.handshakeTimeout
+	}
+	return defaultHandshakeTimeout
+}
+
+// clientTLSConfig returns the tls.Config used to connect to addr
+func (dc *dialConfig) clientTLSConfig(serverName string, cert *tls.Certificate) *tls.Config {
+	var conf *tls.Config
+	if dc != nil && dc.tlsConfig != nil {
+		conf = dc.tlsConfig.Clone()
+	} else {
+		conf = &tls.Config{}
+	}
+
+	conf.Certificates = []tls.Certificate{*cert}
+	if conf.ServerName == "" {
+		conf.ServerName = serverName
+	}
+
+	return conf
+}
+
+// PinPublicKeys returns a copy of conf that only accepts server certificate
+// chains containing one of the given public keys, in addition to the usual
+// verification. Pins are base64-encoded SHA-256 hashes of DER-encoded
+// SubjectPublicKeyInfos, as printed by:
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func PinPublicKeys(conf *tls.Config, pins ...string) (*tls.Config, error) {
+	if len(pins) == 0 {
+		return nil, errors.New("no public key pins")
+	}
+
+	hashes := make(map[[sha256.Size]byte]bool)
+	for _, pin := range pins {
+		b, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid public key pin %q", pin)
+		}
+		var h [sha256.Size]byte
+		copy(h[:], b)
+		hashes[h] = true
+	}
+
+	if conf == nil {
+		conf = &tls.Config{}
+	} else {
+		conf = conf.Clone()
+	}
+
+	verify := conf.VerifyConnection
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		if !hasPinnedKey(cs.PeerCertificates, hashes) {
+			return errors.New("apns: server certificate chain does not match the pinned public keys")
+		}
+		return nil
+	}
+
+	return conf, nil
+}
+
+func hasPinnedKey(certs []*x509.Certificate, hashes map[[sha256.Size]byte]bool) bool {
+	for _, c := range certs {
+		if hashes[sha256.Sum256(c.RawSubjectPublicKeyInfo)] {
+			return true
+		}
+	}
+	return false
+}
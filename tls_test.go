@@ -0,0 +1,196 @@
+package apns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testGateway is a local TLS server standing in for APNs
+type testGateway struct {
+	addr  string
+	cert  *x509.Certificate
+	roots *x509.CertPool
+	ln    net.Listener
+}
+
+// newTestGateway starts a testGateway calling handle with each accepted
+// connection
+func newTestGateway(t *testing.T, handle func(c net.Conn)) *testGateway {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:     []string{"localhost"},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	require.NoError(t, err)
+
+	g := &testGateway{
+		addr:  ln.Addr().String(),
+		cert:  cert,
+		roots: x509.NewCertPool(),
+		ln:    ln,
+	}
+	g.roots.AddCert(cert)
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				handle(c)
+			}()
+		}
+	}()
+
+	return g
+}
+
+func (g *testGateway) Close() {
+	g.ln.Close()
+}
+
+func (g *testGateway) pin() string {
+	h := sha256.Sum256(g.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func newTestFeedbackGateway(t *testing.T) *testGateway {
+	return newTestGateway(t, func(c net.Conn) {
+		buf := &bytes.Buffer{}
+		writeFeedbackTuple(buf, 1400000000, "0000000000000000000000000000000000000000000000000000000000000001")
+		c.Write(buf.Bytes())
+	})
+}
+
+func TestFetchFeedbackWithCustomRoots(t *testing.T) {
+
+	g := newTestFeedbackGateway(t)
+	defer g.Close()
+
+	cert := newTestCertificate(t, time.Now().Add(time.Hour))
+
+	_, err := FetchFeedback(context.Background(), g.addr, cert)
+	assert.Error(t, err, "the gateway certificate is not trusted by default")
+
+	msgs, err := FetchFeedback(context.Background(), g.addr, cert, FeedbackTLSConfig(&tls.Config{
+		RootCAs:    g.roots,
+		MinVersion: tls.VersionTLS12,
+	}))
+	require.NoError(t, err)
+
+	assert.Equal(t, []*FeedbackMessage{
+		{Unsubscribe: time.Unix(1400000000, 0), DeviceToken: "0000000000000000000000000000000000000000000000000000000000000001"},
+	}, msgs)
+}
+
+func TestPinPublicKeys(t *testing.T) {
+
+	g := newTestFeedbackGateway(t)
+	defer g.Close()
+
+	cert := newTestCertificate(t, time.Now().Add(time.Hour))
+	conf := &tls.Config{RootCAs: g.roots}
+
+	pinned, err := PinPublicKeys(conf, g.pin())
+	require.NoError(t, err)
+
+	msgs, err := FetchFeedback(context.Background(), g.addr, cert, FeedbackTLSConfig(pinned))
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+
+	other := sha256.Sum256([]byte("other key"))
+	pinned, err = PinPublicKeys(conf, base64.StdEncoding.EncodeToString(other[:]))
+	require.NoError(t, err)
+
+	_, err = FetchFeedback(context.Background(), g.addr, cert, FeedbackTLSConfig(pinned))
+	assert.Error(t, err)
+
+	_, err = PinPublicKeys(conf, "not a pin")
+	assert.Error(t, err)
+}
+
+func TestSenderWithCustomRoots(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	frames := make(chan []byte, 1)
+
+	g := newTestGateway(t, func(c net.Conn) {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(c, header); err != nil {
+			return
+		}
+		frame := make([]byte, int(header[1])<<24|int(header[2])<<16|int(header[3])<<8|int(header[4]))
+		if _, err := io.ReadFull(c, frame); err != nil {
+			return
+		}
+		frames <- append(header, frame...)
+		io.Copy(io.Discard, c)
+	})
+	defer g.Close()
+
+	cert := newTestCertificate(t, time.Now().Add(time.Hour))
+
+	s := NewSender(ctx, g.addr, cert, SenderTLSConfig(&tls.Config{RootCAs: g.roots}))
+	go drainErrors(s)
+
+	n := NewNotification()
+	n.SetDeviceToken("0000000000000000000000000000000000000000000000000000000000000001")
+	n.SetIdentifier(1)
+	s.Notifications() <- n
+
+	expected, err := n.Encode()
+	require.NoError(t, err)
+
+	select {
+	case frame := <-frames:
+		assert.Equal(t, expected, frame)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the notification")
+	}
+
+	cancel()
+
+	<-s.Done()
+}
@@ -0,0 +1,59 @@
+package apns
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// Lengths of device tokens, in bytes. Tokens are 32 bytes long, but Apple
+// announced that they may grow.
+const (
+	MinDeviceTokenLen = 32
+	MaxDeviceTokenLen = 100
+)
+
+// DeviceToken is a device token, as a lowercase hex string
+type DeviceToken string
+
+// ParseDeviceToken parses a hex device token. Spaces and angle brackets are
+// ignored, so that the description of the NSData token (e.g.
+// "<740f4707 bebcf74f ...>") can be parsed. It returns an *InvalidTokenError
+// if s is not valid hex or is not between MinDeviceTokenLen and
+// MaxDeviceTokenLen bytes long; errors.Is(err, ErrInvalidTokenSize) reports
+// the latter.
+func ParseDeviceToken(s string) (DeviceToken, error) {
+	token := normalizeDeviceToken(s)
+
+	b, err := hex.DecodeString(token)
+	if err != nil {
+		return "", &InvalidTokenError{Token: s, Err: err}
+	}
+	if len(b) < MinDeviceTokenLen || len(b) > MaxDeviceTokenLen {
+		return "", &InvalidTokenError{Token: s, Err: ErrInvalidTokenSize}
+	}
+
+	return DeviceToken(token), nil
+}
+
+// String returns the token as a lowercase hex string
+func (t DeviceToken) String() string {
+	return string(t)
+}
+
+// Bytes returns the decoded token
+func (t DeviceToken) Bytes() []byte {
+	b, _ := hex.DecodeString(string(t))
+	return b
+}
+
+// normalizeDeviceToken removes spaces and angle brackets from token and
+// lowercases it
+func normalizeDeviceToken(token string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '<', '>':
+			return -1
+		}
+		return r
+	}, strings.ToLower(token))
+}
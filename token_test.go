@@ -0,0 +1,71 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDeviceToken(t *testing.T) {
+
+	expected := DeviceToken("740f4707bebcf74f9b7c25d48e3358945f6aa01da5ddb387462c7eaf61bb78ad")
+
+	for _, s := range []string{
+		"740f4707bebcf74f9b7c25d48e3358945f6aa01da5ddb387462c7eaf61bb78ad",
+		"740F4707BEBCF74F9B7C25D48E3358945F6AA01DA5DDB387462C7EAF61BB78AD",
+		"<740f4707 bebcf74f 9b7c25d4 8e335894 5f6aa01d a5ddb387 462c7eaf 61bb78ad>",
+	} {
+		token, err := ParseDeviceToken(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, expected, token)
+	}
+
+	b, _ := hex.DecodeString(string(expected))
+	assert.Equal(t, b, expected.Bytes())
+
+	var tokenErr *InvalidTokenError
+
+	_, err := ParseDeviceToken("740f4707bebcf74g")
+	assert.True(t, errors.As(err, &tokenErr))
+	assert.False(t, errors.Is(err, ErrInvalidTokenSize))
+
+	_, err = ParseDeviceToken("740f4707bebcf74f")
+	assert.True(t, errors.As(err, &tokenErr))
+	assert.True(t, errors.Is(err, ErrInvalidTokenSize))
+
+	_, err = ParseDeviceToken("")
+	assert.True(t, errors.Is(err, ErrInvalidTokenSize))
+
+	long := strings.Repeat("ab", MaxDeviceTokenLen)
+	token, err := ParseDeviceToken(long)
+	require.NoError(t, err)
+	assert.Equal(t, DeviceToken(long), token)
+
+	_, err = ParseDeviceToken(long + "ab")
+	assert.True(t, errors.Is(err, ErrInvalidTokenSize))
+}
+
+func TestEncodeVariableLengthTokens(t *testing.T) {
+
+	for _, l := range []int{MinDeviceTokenLen, 64, MaxDeviceTokenLen} {
+		n := NewNotification()
+		n.SetIdentifier(1)
+		n.SetDeviceToken(strings.Repeat("ab", l))
+
+		b, err := n.Encode()
+		require.NoError(t, err)
+
+		// the token item follows the 5 bytes header
+		assert.Equal(t, []byte{1, 0, byte(l)}, b[5:8])
+		assert.Equal(t, bytes.Repeat([]byte{0xab}, l), b[8:8+l])
+
+		decoded, err := decodeNotification(b)
+		require.NoError(t, err)
+		assert.Equal(t, n.DeviceToken(), decoded.DeviceToken())
+	}
+}